@@ -0,0 +1,192 @@
+/*
+Incoming!! adaptive chunk size and send-ahead
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"time"
+)
+
+const (
+	// how often chunkTuner may change chunk size and send-ahead
+	tunerInterval = 2 * time.Second
+
+	// how many round trip samples chunkTuner needs before it changes anything
+	tunerMinSamples = 4
+
+	// how many round trip samples chunkTuner remembers
+	tunerMaxSamples = 16
+
+	// chunkTuner prefers to keep this many chunks in flight, and adjusts the
+	// chunk size accordingly
+	tunerPreferredSendAhead = 4
+)
+
+// chunkTuner measures round trip times and throughput of a websocket
+// connection, and suggests chunk size and send-ahead for the connection so
+// that there are enough bytes in flight to keep the link busy.
+//
+// Round trip times are measured from the sender's flow control: the sender
+// may be SendAhead chunks ahead of the acks it got, so chunk number k can
+// only be sent after the ack for chunk number (k - SendAhead) has arrived.
+// The time between sending that ack and receiving chunk k is a round trip
+// (plus the time the sender needs to read the chunk). If the sender is not
+// held back by the window, the sample is too large, which is why chunkTuner
+// uses the smallest of the recent samples.
+//
+// A chunkTuner is not safe for concurrent use; each websocket handler has its
+// own.
+type chunkTuner struct {
+	minChunkSizeKB uint
+	maxChunkSizeKB uint
+	minSendAhead   uint
+	maxSendAhead   uint
+
+	// what the sender uses right now
+	chunkSizeKB uint
+	sendAhead   uint
+
+	// when acks were sent. ackTimes[0] is the time of ack number ackBase.
+	ackTimes []time.Time
+	ackBase  int
+
+	// number of chunks received on this connection
+	chunksReceived int
+
+	// chunks below this number were sent with an older send-ahead and can't
+	// be used for round trip measurements
+	settleUntil int
+
+	rttSamples []time.Duration
+
+	intervalStart time.Time
+	intervalBytes int64
+}
+
+// newChunkTuner makes a chunkTuner for a connection that starts out with the
+// given chunk size and send-ahead, and that may adjust them within the given
+// bounds.
+func newChunkTuner(chunkSizeKB, sendAhead, minChunkSizeKB, maxChunkSizeKB,
+	minSendAhead, maxSendAhead uint) *chunkTuner {
+	t := new(chunkTuner)
+	t.chunkSizeKB = chunkSizeKB
+	t.sendAhead = sendAhead
+	t.minChunkSizeKB = minChunkSizeKB
+	t.maxChunkSizeKB = maxChunkSizeKB
+	t.minSendAhead = minSendAhead
+	t.maxSendAhead = maxSendAhead
+	t.intervalStart = time.Now()
+	return t
+}
+
+// chunkReceived should be called whenever a file chunk has arrived
+func (t *chunkTuner) chunkReceived(size int) {
+	now := time.Now()
+	k := t.chunksReceived
+	t.chunksReceived++
+	t.intervalBytes += int64(size)
+
+	// which ack allowed the sender to send this chunk?
+	ackNo := k - int(t.sendAhead)
+	if k < t.settleUntil || ackNo < t.ackBase || ackNo-t.ackBase >= len(t.ackTimes) {
+		return
+	}
+	rtt := now.Sub(t.ackTimes[ackNo-t.ackBase])
+	t.rttSamples = append(t.rttSamples, rtt)
+	if len(t.rttSamples) > tunerMaxSamples {
+		t.rttSamples = t.rttSamples[1:]
+	}
+
+	// we won't need older ack times any more
+	if drop := ackNo - t.ackBase; drop > 0 {
+		t.ackTimes = t.ackTimes[drop:]
+		t.ackBase += drop
+	}
+}
+
+// ackSent should be called whenever a chunk ack has been sent
+func (t *chunkTuner) ackSent() {
+	t.ackTimes = append(t.ackTimes, time.Now())
+}
+
+// adjust looks at the measurements so far and decides whether chunk size and
+// send-ahead should change. If they should, it returns the new values and
+// true, and assumes that the sender will use them from now on.
+func (t *chunkTuner) adjust() (chunkSizeKB uint, sendAhead uint, changed bool) {
+	elapsed := time.Since(t.intervalStart)
+	if elapsed < tunerInterval || len(t.rttSamples) < tunerMinSamples {
+		return t.chunkSizeKB, t.sendAhead, false
+	}
+
+	rtt := t.rttSamples[0]
+	for _, s := range t.rttSamples {
+		if s < rtt {
+			rtt = s
+		}
+	}
+	if rtt <= 0 {
+		rtt = time.Millisecond
+	}
+	throughput := float64(t.intervalBytes) / elapsed.Seconds()
+	inFlight := float64(t.chunkSizeKB*1024) * float64(t.sendAhead)
+	windowRate := inFlight / rtt.Seconds()
+
+	// if we get (almost) as much as the window allows, the window is what
+	// holds the sender back, so we make it larger. If we get much less,
+	// something else is the bottleneck, and we shrink the window to what is
+	// needed (with some headroom).
+	target := inFlight
+	if throughput >= 0.8*windowRate {
+		target = 2 * inFlight
+	} else if needed := 2 * throughput * rtt.Seconds(); needed < inFlight/2 {
+		target = needed
+	}
+
+	chunkSizeKB = clampUint(uint(target/tunerPreferredSendAhead/1024),
+		t.minChunkSizeKB, t.maxChunkSizeKB)
+	sendAhead = clampUint(uint(target/float64(chunkSizeKB*1024)+0.5),
+		t.minSendAhead, t.maxSendAhead)
+
+	// start a new measurement interval
+	t.intervalStart = time.Now()
+	t.intervalBytes = 0
+
+	if chunkSizeKB == t.chunkSizeKB && sendAhead == t.sendAhead {
+		return chunkSizeKB, sendAhead, false
+	}
+
+	// chunks that are in flight right now were sent with the old
+	// parameters, so we can't use them for measurements
+	t.settleUntil = t.chunksReceived + int(t.sendAhead) + int(sendAhead)
+	t.rttSamples = nil
+	t.chunkSizeKB = chunkSizeKB
+	t.sendAhead = sendAhead
+	return chunkSizeKB, sendAhead, true
+}
+
+// clampUint returns v, but at least min and at most max
+func clampUint(v, min, max uint) uint {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
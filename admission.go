@@ -0,0 +1,123 @@
+/*
+Incoming!! admission control
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// admissionT counts websocket connections per client IP and uploads that are
+// active (i.e., have a websocket connection) right now, so that we can turn
+// away connections when there are too many. Limits are read from the app
+// config on each call, so they change when the config is reloaded.
+type admissionT struct {
+	lock          sync.Mutex
+	activeUploads uint
+	connsPerIP    map[string]uint
+}
+
+func newAdmission() *admissionT {
+	a := new(admissionT)
+	a.connsPerIP = make(map[string]uint)
+	return a
+}
+
+// acquireConn counts a new websocket connection from the given IP. It returns
+// false if that IP has too many connections already. Call releaseConn when
+// the connection is gone (only if acquireConn returned true).
+func (a *admissionT) acquireConn(ip string) bool {
+	max := appVars.getConfig().MaxConnectionsPerIP
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if max > 0 && a.connsPerIP[ip] >= max {
+		return false
+	}
+	a.connsPerIP[ip]++
+	return true
+}
+
+func (a *admissionT) releaseConn(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.connsPerIP[ip]--
+	if a.connsPerIP[ip] == 0 {
+		delete(a.connsPerIP, ip)
+	}
+}
+
+// acquireUpload counts a new active upload. It returns false if there are too
+// many already. Call releaseUpload when the upload is no longer active (only
+// if acquireUpload returned true).
+func (a *admissionT) acquireUpload() bool {
+	max := appVars.getConfig().MaxActiveUploads
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if max > 0 && a.activeUploads >= max {
+		return false
+	}
+	a.activeUploads++
+	return true
+}
+
+func (a *admissionT) releaseUpload() {
+	a.lock.Lock()
+	a.activeUploads--
+	a.lock.Unlock()
+}
+
+// getActiveUploads returns the number of uploads that have a websocket
+// connection right now
+func (a *admissionT) getActiveUploads() uint {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.activeUploads
+}
+
+// canIssueTicket returns false if a ticket for the given number of files
+// would make too many upload tickets. Each file counts as a ticket, whether
+// it has a ticket of its own or belongs to a batch, and batches count with
+// all the files they may still start.
+func (a *admissionT) canIssueTicket(files uint) bool {
+	max := appVars.getConfig().MaxOutstandingTickets
+	if max == 0 {
+		return true
+	}
+	outstanding := uint(appVars.uploaders.Size()) +
+		uint(appVars.batches.PendingFiles())
+	return outstanding+files <= max
+}
+
+// clientIP returns the IP address of the client that sent the request. If
+// the app config says so, the X-Real-IP header set by a reverse proxy is
+// trusted.
+func clientIP(r *http.Request) string {
+	if appVars.getConfig().TrustProxyHeaders {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
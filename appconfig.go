@@ -22,12 +22,17 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"bitbucket.org/kardianos/osext"
 	"gopkg.in/yaml.v1"
+
+	"github.com/uit-no/incoming/logging"
+	"github.com/uit-no/incoming/upload"
 )
 
 // appConfigT: the yaml config file we get on app startup will be parsed into
@@ -39,15 +44,317 @@ type appConfigT struct {
 	UploadChunkSizeKB           uint   `yaml:"UploadChunkSizeKB"`
 	UploadSendAhead             uint   `yaml:"UploadSendAhead"`
 	UploadMaxIdleDurationS      uint   `yaml:"UploadMaxIdleDurationS"`
+	UploadMaxPausedDurationS    uint   `yaml:"UploadMaxPausedDurationS"`
+	UploadMaxConnections        uint   `yaml:"UploadMaxConnections"`
+	UploadCompression           bool   `yaml:"UploadCompression"`
 	WebsocketConnectionTimeoutS uint   `yaml:"WebsocketConnectionTimeoutS"`
+	WebsocketPingIntervalS      uint   `yaml:"WebsocketPingIntervalS"`
 	StorageDir                  string `yaml:"StorageDir"`
 	HandoverTimeoutS            uint   `yaml:"HandoverTimeoutS"`
 	HandoverConfirmTimeoutS     uint   `yaml:"HandoverConfirmTimeoutS"`
+	HandoverRetryWindowS        uint   `yaml:"HandoverRetryWindowS"`
+	AdminSecret                 string `yaml:"AdminSecret"`
+
+	// upper bounds for per-upload overrides of the upload config (0: can't
+	// be overridden)
+	MaxUploadChunkSizeKB        uint `yaml:"MaxUploadChunkSizeKB"`
+	MaxUploadSendAhead          uint `yaml:"MaxUploadSendAhead"`
+	MaxUploadMaxIdleDurationS   uint `yaml:"MaxUploadMaxIdleDurationS"`
+	MaxUploadMaxPausedDurationS uint `yaml:"MaxUploadMaxPausedDurationS"`
+	MaxHandoverTimeoutS         uint `yaml:"MaxHandoverTimeoutS"`
+	MaxHandoverConfirmTimeoutS  uint `yaml:"MaxHandoverConfirmTimeoutS"`
+
+	// limits for batch tickets: files per batch (0: no batches), and total
+	// size of a batch in MB (0: unlimited)
+	MaxBatchFiles   uint `yaml:"MaxBatchFiles"`
+	MaxBatchTotalMB uint `yaml:"MaxBatchTotalMB"`
+
+	// how large the metadata of a ticket may be, in bytes (keys and values
+	// together, 0: tickets can't have metadata)
+	MaxMetadataBytes uint `yaml:"MaxMetadataBytes"`
+
+	// where uploaded files are kept by content, so that the same file
+	// doesn't have to be uploaded twice ("": no deduplication), and for how
+	// long a file is kept after it was last used (0: forever)
+	DedupDir     string `yaml:"DedupDir"`
+	DedupRetainS uint   `yaml:"DedupRetainS"`
+
+	// encryption of files at rest: the master key (64 hex digits), or a file
+	// that has it ("" for both: no encryption), and whether files are handed
+	// over "decrypted" or "encrypted" (with their wrapped key)
+	EncryptionKey      string `yaml:"EncryptionKey"`
+	EncryptionKeyFile  string `yaml:"EncryptionKeyFile"`
+	EncryptionHandover string `yaml:"EncryptionHandover"`
+
+	// scanning of files before handover: a command that gets the file's path
+	// (clamscan style), or the address of clamd (a unix socket or host:port),
+	// or neither (no scanning). ScanPolicy says what happens to infected
+	// files: "cancel" the upload, "quarantine" the file in ScanQuarantineDir
+	// and cancel the upload, or "flag" it in the handover.
+	ScanCommand       []string `yaml:"ScanCommand"`
+	ScanClamdAddress  string   `yaml:"ScanClamdAddress"`
+	ScanTimeoutS      uint     `yaml:"ScanTimeoutS"`
+	ScanPolicy        string   `yaml:"ScanPolicy"`
+	ScanQuarantineDir string   `yaml:"ScanQuarantineDir"`
+
+	// processing steps that run on each file after scanning and before
+	// handover (see upload.ProcessingStep)
+	ProcessingSteps []processingStepConf `yaml:"ProcessingSteps"`
+
+	// adapt chunk size and send-ahead to the connection during uploads?
+	AdaptiveUpload         bool `yaml:"AdaptiveUpload"`
+	AdaptiveMinChunkSizeKB uint `yaml:"AdaptiveMinChunkSizeKB"`
+	AdaptiveMaxChunkSizeKB uint `yaml:"AdaptiveMaxChunkSizeKB"`
+	AdaptiveMinSendAhead   uint `yaml:"AdaptiveMinSendAhead"`
+	AdaptiveMaxSendAhead   uint `yaml:"AdaptiveMaxSendAhead"`
+
+	// bandwidth limits in KB per second (0: unlimited)
+	RateLimitGlobalKBps uint `yaml:"RateLimitGlobalKBps"`
+	RateLimitTenantKBps uint `yaml:"RateLimitTenantKBps"`
+	RateLimitUploadKBps uint `yaml:"RateLimitUploadKBps"`
+
+	// admission control (0: unlimited)
+	MaxActiveUploads      uint `yaml:"MaxActiveUploads"`
+	MaxOutstandingTickets uint `yaml:"MaxOutstandingTickets"`
+	MaxConnectionsPerIP   uint `yaml:"MaxConnectionsPerIP"`
+	BusyRetryAfterS       uint `yaml:"BusyRetryAfterS"`
+
+	// trust the X-Real-IP header of requests (set by a reverse proxy)?
+	TrustProxyHeaders bool `yaml:"TrustProxyHeaders"`
+
+	// logging: level ("debug", "info", "warn", "error"), format ("logfmt" or
+	// "json"), and whether requests to the backend and admin APIs are logged
+	LogLevel  string `yaml:"LogLevel"`
+	LogFormat string `yaml:"LogFormat"`
+	AccessLog bool   `yaml:"AccessLog"`
+
+	// global subscription to upload events (see events.go), and how events
+	// are delivered
+	EventURL             string   `yaml:"EventURL"`
+	Events               []string `yaml:"Events"`
+	EventProgressPercent uint     `yaml:"EventProgressPercent"`
+	EventProgressMB      uint     `yaml:"EventProgressMB"`
+	EventTimeoutS        uint     `yaml:"EventTimeoutS"`
+	EventMaxRetries      uint     `yaml:"EventMaxRetries"`
+
+	// made from the Scan* settings by LoadConfig (nil: no scanning)
+	scanner *upload.Scanner
+
+	// made from ProcessingSteps by LoadConfig (nil: no processing)
+	pipeline *upload.Pipeline
+}
+
+// processingStepConf is a processing step as it is in the config file
+type processingStepConf struct {
+	Name      string   `yaml:"Name"`
+	Type      string   `yaml:"Type"`
+	Algorithm string   `yaml:"Algorithm"`
+	Command   []string `yaml:"Command"`
+	TimeoutS  uint     `yaml:"TimeoutS"`
+	Optional  bool     `yaml:"Optional"`
+}
+
+// globalEventSub makes the global event subscription from the config
+func (c *appConfigT) globalEventSub() (*eventSub, error) {
+	return newEventSub(c.EventURL, strings.Join(c.Events, ","),
+		c.EventProgressPercent, int64(c.EventProgressMB)*1024*1024)
+}
+
+// setDefaults fills in values for settings that are missing in the config
+// file, where there is a sensible default
+func (c *appConfigT) setDefaults() {
+	if c.WebsocketPingIntervalS == 0 {
+		c.WebsocketPingIntervalS = c.WebsocketConnectionTimeoutS / 2
+	}
+	if c.BusyRetryAfterS == 0 {
+		c.BusyRetryAfterS = 30
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.LogFormat == "" {
+		c.LogFormat = logging.FormatLogfmt
+	}
+	if c.EventTimeoutS == 0 {
+		c.EventTimeoutS = 10
+	}
+	if c.EncryptionHandover == "" {
+		c.EncryptionHandover = "decrypted"
+	}
+	if c.ScanPolicy == "" {
+		c.ScanPolicy = upload.ScanPolicyCancel
+	}
+}
+
+// validate checks whether the config values make sense
+func (c *appConfigT) validate() error {
+	if c.UploadChunkSizeKB == 0 {
+		return fmt.Errorf("UploadChunkSizeKB must be greater than 0")
+	}
+	if c.UploadSendAhead == 0 {
+		return fmt.Errorf("UploadSendAhead must be greater than 0")
+	}
+	if c.WebsocketPingIntervalS == 0 ||
+		c.WebsocketPingIntervalS >= c.WebsocketConnectionTimeoutS {
+		return fmt.Errorf("WebsocketPingIntervalS must be greater than 0 and " +
+			"smaller than WebsocketConnectionTimeoutS")
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != logging.FormatLogfmt && c.LogFormat != logging.FormatJSON {
+		return fmt.Errorf("LogFormat must be '%s' or '%s'", logging.FormatLogfmt,
+			logging.FormatJSON)
+	}
+	if c.EventURL != "" {
+		if _, err := c.globalEventSub(); err != nil {
+			return fmt.Errorf("global event subscription is invalid: %s", err)
+		}
+	}
+	if c.DedupDir != "" {
+		// StorageDir is emptied on start, so the store can't be in there
+		storageDir, _ := filepath.Abs(c.StorageDir)
+		dedupDir, _ := filepath.Abs(c.DedupDir)
+		if dedupDir == storageDir ||
+			strings.HasPrefix(dedupDir, storageDir+string(filepath.Separator)) {
+			return fmt.Errorf("DedupDir must not be within StorageDir")
+		}
+	}
+	if _, err := c.encryption(); err != nil {
+		return err
+	}
+	if c.DedupDir != "" && (c.EncryptionKey != "" || c.EncryptionKeyFile != "") {
+		return fmt.Errorf("DedupDir can't be used together with encryption")
+	}
+	if len(c.ScanCommand) > 0 && c.EncryptionHandover == "encrypted" &&
+		(c.EncryptionKey != "" || c.EncryptionKeyFile != "") {
+		// files are never in plain on disk then
+		return fmt.Errorf("ScanCommand can't be used with encrypted handover, " +
+			"use ScanClamdAddress instead")
+	}
+	if _, err := c.newPipeline(); err != nil {
+		return err
+	}
+	for _, step := range c.ProcessingSteps {
+		if step.Type == upload.StepCommand && c.EncryptionHandover == "encrypted" &&
+			(c.EncryptionKey != "" || c.EncryptionKeyFile != "") {
+			return fmt.Errorf("processing steps of type '%s' can't be used "+
+				"with encrypted handover", upload.StepCommand)
+		}
+	}
+	if c.AdaptiveUpload {
+		if c.AdaptiveMinChunkSizeKB == 0 ||
+			c.AdaptiveMinChunkSizeKB > c.AdaptiveMaxChunkSizeKB {
+			return fmt.Errorf("AdaptiveMinChunkSizeKB must be greater than 0 " +
+				"and not greater than AdaptiveMaxChunkSizeKB")
+		}
+		if c.AdaptiveMinSendAhead == 0 ||
+			c.AdaptiveMinSendAhead > c.AdaptiveMaxSendAhead {
+			return fmt.Errorf("AdaptiveMinSendAhead must be greater than 0 " +
+				"and not greater than AdaptiveMaxSendAhead")
+		}
+	}
+	return nil
+}
+
+// encryption makes the encryption of files at rest from the config. It
+// returns nil if files aren't encrypted.
+func (c *appConfigT) encryption() (*upload.Encryption, error) {
+	keyHex := c.EncryptionKey
+	switch {
+	case c.EncryptionKey != "" && c.EncryptionKeyFile != "":
+		return nil, fmt.Errorf("only one of EncryptionKey and EncryptionKeyFile " +
+			"may be set")
+	case c.EncryptionKeyFile != "":
+		b, err := ioutil.ReadFile(c.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read EncryptionKeyFile: %s", err)
+		}
+		keyHex = string(b)
+	case c.EncryptionKey == "":
+		return nil, nil
+	}
+	key, err := upload.ParseKey(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is invalid: %s", err)
+	}
+	if c.EncryptionHandover != "decrypted" && c.EncryptionHandover != "encrypted" {
+		return nil, fmt.Errorf("EncryptionHandover must be 'decrypted' or " +
+			"'encrypted'")
+	}
+	return upload.NewEncryption(key, c.EncryptionHandover == "encrypted")
+}
+
+// newScanner makes the scanner of files before handover from the config. It
+// returns nil if files aren't scanned.
+func (c *appConfigT) newScanner() (*upload.Scanner, error) {
+	if len(c.ScanCommand) == 0 && c.ScanClamdAddress == "" {
+		return nil, nil
+	}
+	return upload.NewScanner(c.ScanCommand, c.ScanClamdAddress,
+		time.Duration(c.ScanTimeoutS)*time.Second, c.ScanPolicy,
+		c.ScanQuarantineDir)
+}
+
+// newPipeline makes the processing pipeline from the config. It returns nil if
+// there are no processing steps.
+func (c *appConfigT) newPipeline() (*upload.Pipeline, error) {
+	if len(c.ProcessingSteps) == 0 {
+		return nil, nil
+	}
+	steps := make([]upload.ProcessingStep, len(c.ProcessingSteps))
+	for i, step := range c.ProcessingSteps {
+		steps[i] = upload.ProcessingStep{
+			Name:      step.Name,
+			Kind:      step.Type,
+			Algorithm: step.Algorithm,
+			Command:   step.Command,
+			Timeout:   time.Duration(step.TimeoutS) * time.Second,
+			Optional:  step.Optional,
+		}
+	}
+	return upload.NewPipeline(steps)
+}
+
+// configureLogging sets up the logging package according to the config.
+// Level and format must have been validated.
+func (c *appConfigT) configureLogging() {
+	level, _ := logging.ParseLevel(c.LogLevel)
+	_ = logging.Configure(level, c.LogFormat)
+}
+
+// uploadConfig returns the default upload config, as derived from the app
+// config
+func (c *appConfigT) uploadConfig() upload.Config {
+	return upload.Config{
+		ChunkSizeKB:            c.UploadChunkSizeKB,
+		SendAhead:              c.UploadSendAhead,
+		MaxConnections:         c.UploadMaxConnections,
+		IdleTimeout:            time.Duration(c.UploadMaxIdleDurationS) * time.Second,
+		PausedTimeout:          time.Duration(c.UploadMaxPausedDurationS) * time.Second,
+		HandoverTimeout:        time.Duration(c.HandoverTimeoutS) * time.Second,
+		HandoverConfirmTimeout: time.Duration(c.HandoverConfirmTimeoutS) * time.Second,
+		HandoverRetryWindow:    time.Duration(c.HandoverRetryWindowS) * time.Second,
+		Dedup:                  appVars.dedup,
+		Encryption:             appVars.encryption,
+		Scanner:                c.scanner,
+		Processing:             c.pipeline,
+	}
 }
 
 func LoadConfig() (c *appConfigT, e error) {
+	c, fPath, e := readConfigFile()
+	if e != nil {
+		return
+	}
+	e = c.prepare(fPath)
+	return
+}
+
+// readConfigFile finds, reads and parses the config file, and fills in
+// defaults. The config still has to be prepared (see prepare).
+func readConfigFile() (c *appConfigT, fPath string, e error) {
 	// find out which file to load
-	fPath := ""
 	if _, e = os.Stat("incoming_cfg.yaml"); e == nil {
 		fPath = "incoming_cfg.yaml"
 	} else {
@@ -66,7 +373,7 @@ func LoadConfig() (c *appConfigT, e error) {
 	var fileContent []byte
 	fileContent, e = ioutil.ReadFile(fPath)
 	if e != nil {
-		log.Printf("Couldn't read config file %s: %s", fPath, e.Error())
+		logging.Error("couldn't read config file", "path", fPath, "err", e)
 		return
 	}
 
@@ -74,10 +381,83 @@ func LoadConfig() (c *appConfigT, e error) {
 	c = new(appConfigT)
 	e = yaml.Unmarshal(fileContent, c)
 	if e != nil {
-		log.Printf("Couldn't parse config file %s: %s", fPath, e.Error())
+		logging.Error("couldn't parse config file", "path", fPath, "err", e)
 		return
 	}
+	c.setDefaults()
 
 	// TODO: fiddle in other sources for config vars: env vars, command line
 	return
 }
+
+// prepare validates the config (which was read from the file at fPath), and
+// sets up what is made from it.
+func (c *appConfigT) prepare(fPath string) (e error) {
+	e = c.validate()
+	if e != nil {
+		logging.Error("config file is invalid", "path", fPath, "err", e)
+		return
+	}
+	c.scanner, e = c.newScanner()
+	if e != nil {
+		logging.Error("couldn't set up scanning of files", "path", fPath, "err", e)
+		return
+	}
+	c.pipeline, _ = c.newPipeline() // validate has checked it
+	return
+}
+
+// ReloadConfig loads the config file again and replaces the app config with
+// it. Settings that can't change while the server runs (IncomingIP,
+// IncomingPort, StorageDir, DedupDir, encryption) keep their old values, and
+// the config must be valid with them. Uploads whose config is reloadable get
+// the new default upload config, all other uploads keep theirs. New uploads
+// and new websocket connections use the new config.
+func ReloadConfig() error {
+	c, fPath, err := readConfigFile()
+	if err != nil {
+		return err
+	}
+
+	oldC := appVars.getConfig()
+	if c.IncomingIP != oldC.IncomingIP || c.IncomingPort != oldC.IncomingPort ||
+		c.StorageDir != oldC.StorageDir || c.DedupDir != oldC.DedupDir ||
+		c.EncryptionKey != oldC.EncryptionKey ||
+		c.EncryptionKeyFile != oldC.EncryptionKeyFile ||
+		c.EncryptionHandover != oldC.EncryptionHandover {
+		logging.Warn("IncomingIP, IncomingPort, StorageDir, DedupDir and " +
+			"encryption settings can't be changed without restart, keeping " +
+			"old values")
+	}
+	c.IncomingIP = oldC.IncomingIP
+	c.IncomingPort = oldC.IncomingPort
+	c.StorageDir = oldC.StorageDir
+	c.DedupDir = oldC.DedupDir
+	c.EncryptionKey = oldC.EncryptionKey
+	c.EncryptionKeyFile = oldC.EncryptionKeyFile
+	c.EncryptionHandover = oldC.EncryptionHandover
+
+	// the config we install must be valid as it is
+	err = c.prepare(fPath)
+	if err != nil {
+		return err
+	}
+
+	appVars.setConfig(c)
+	appVars.bandwidth.setLimits(c)
+	c.configureLogging()
+
+	// update reloadable uploads (their overrides still apply)
+	defaultConf := c.uploadConfig()
+	defaultConf.Reloadable = true
+	for _, uploader := range appVars.uploaders.GetAll() {
+		oldConf := uploader.GetConfig()
+		if oldConf.Reloadable {
+			conf := oldConf.Overrides.Apply(defaultConf)
+			_ = uploader.SetConfig(conf) // fails for uploads that are done
+		}
+	}
+
+	logging.Info("config reloaded")
+	return nil
+}
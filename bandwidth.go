@@ -0,0 +1,147 @@
+/*
+Incoming!! bandwidth limits
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"sync"
+
+	"github.com/uit-no/incoming/ratelimit"
+)
+
+// bandwidthT keeps the rate limiters for all three levels: one global
+// limiter, one per tenant that has an upload connected right now, and one per
+// upload that is connected right now.
+// Limits come from the app config, and are updated when it is reloaded.
+type bandwidthT struct {
+	lock sync.Mutex
+
+	global  *ratelimit.Limiter
+	tenants map[string]*ratelimit.Limiter
+	uploads map[string]*ratelimit.Limiter
+
+	// how many connections each upload has right now (several for parallel
+	// uploads, which share their upload's limiter)
+	uploadConns map[string]int
+
+	// how many connections each tenant has right now. A tenant's limiter
+	// goes away with its last connection.
+	tenantConns map[string]int
+
+	// limits in bytes per second (0: unlimited)
+	tenantLimit uint64
+	uploadLimit uint64
+}
+
+func newBandwidth(c *appConfigT) *bandwidthT {
+	b := new(bandwidthT)
+	b.global = ratelimit.NewLimiter(uint64(c.RateLimitGlobalKBps) * 1024)
+	b.tenants = make(map[string]*ratelimit.Limiter)
+	b.uploads = make(map[string]*ratelimit.Limiter)
+	b.uploadConns = make(map[string]int)
+	b.tenantConns = make(map[string]int)
+	b.tenantLimit = uint64(c.RateLimitTenantKBps) * 1024
+	b.uploadLimit = uint64(c.RateLimitUploadKBps) * 1024
+	return b
+}
+
+// setLimits applies the limits from the given config to all limiters
+func (b *bandwidthT) setLimits(c *appConfigT) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.global.SetLimit(uint64(c.RateLimitGlobalKBps) * 1024)
+	b.tenantLimit = uint64(c.RateLimitTenantKBps) * 1024
+	b.uploadLimit = uint64(c.RateLimitUploadKBps) * 1024
+	for _, l := range b.tenants {
+		l.SetLimit(b.tenantLimit)
+	}
+	for _, l := range b.uploads {
+		l.SetLimit(b.uploadLimit)
+	}
+}
+
+// addUpload returns the limiters for a connection of an upload of the given
+// tenant, and makes them if no other connection (of the upload, or of the
+// tenant) has made them already. Call removeUpload when the connection is
+// gone.
+func (b *bandwidthT) addUpload(id string, tenant string) (upload,
+	tenantLimiter *ratelimit.Limiter) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	upload, ok := b.uploads[id]
+	if !ok {
+		upload = ratelimit.NewLimiter(b.uploadLimit)
+		b.uploads[id] = upload
+	}
+	b.uploadConns[id]++
+	tenantLimiter, ok = b.tenants[tenant]
+	if !ok {
+		tenantLimiter = ratelimit.NewLimiter(b.tenantLimit)
+		b.tenants[tenant] = tenantLimiter
+	}
+	b.tenantConns[tenant]++
+	return
+}
+
+func (b *bandwidthT) removeUpload(id string, tenant string) {
+	b.lock.Lock()
+	b.uploadConns[id]--
+	if b.uploadConns[id] <= 0 {
+		delete(b.uploads, id)
+		delete(b.uploadConns, id)
+	}
+	b.tenantConns[tenant]--
+	if b.tenantConns[tenant] <= 0 {
+		delete(b.tenants, tenant)
+		delete(b.tenantConns, tenant)
+	}
+	b.lock.Unlock()
+}
+
+// upload returns the limiter of an upload, or nil if the upload is not
+// connected right now.
+func (b *bandwidthT) upload(id string) *ratelimit.Limiter {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.uploads[id]
+}
+
+// rateInfo is how we report a rate and its limit in the status and metrics
+// APIs
+type rateInfo struct {
+	RateBytesPerS  float64
+	LimitBytesPerS uint64
+}
+
+func newRateInfo(l *ratelimit.Limiter) rateInfo {
+	return rateInfo{RateBytesPerS: l.Rate(), LimitBytesPerS: l.Limit()}
+}
+
+// rates returns the current global rate, and the rates of all tenants that
+// are connected right now
+func (b *bandwidthT) rates() (global rateInfo, tenants map[string]rateInfo) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	global = newRateInfo(b.global)
+	tenants = make(map[string]rateInfo)
+	for name, l := range b.tenants {
+		tenants[name] = newRateInfo(l)
+	}
+	return
+}
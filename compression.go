@@ -0,0 +1,66 @@
+/*
+Incoming!! compressed file chunks
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// compression methods for file chunks. "deflate-raw" is raw DEFLATE data (RFC
+// 1951), without zlib or gzip wrapping, as browsers' CompressionStream makes
+// it.
+const compressionDeflateRaw = "deflate-raw"
+
+// chooseCompression picks the first of the compression methods the sender
+// offers that we support. It returns "" (no compression) if there is none.
+func chooseCompression(offered []string) string {
+	for _, method := range offered {
+		if method == compressionDeflateRaw {
+			return method
+		}
+	}
+	return ""
+}
+
+// decompressChunk decompresses a file chunk that was compressed with method.
+// It fails if the chunk is larger than maxSize bytes when decompressed, so
+// that a small message can't make us write huge amounts of data
+// (decompression bomb).
+func decompressChunk(method string, data []byte, maxSize int64) ([]byte,
+	error) {
+	if method != compressionDeflateRaw {
+		return nil, fmt.Errorf("unknown compression method %q", method)
+	}
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	chunk, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decompress chunk: %s", err)
+	}
+	if int64(len(chunk)) > maxSize {
+		return nil, fmt.Errorf("chunk is larger than %d bytes when decompressed",
+			maxSize)
+	}
+	return chunk, nil
+}
@@ -0,0 +1,360 @@
+/*
+Incoming!! upload lifecycle events
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uit-no/incoming/logging"
+	"github.com/uit-no/incoming/upload"
+)
+
+// names of the events we can tell subscribers about
+const (
+	eventConnected       = "connected"
+	eventStarted         = "started"
+	eventProgress        = "progress"
+	eventPaused          = "paused"
+	eventReconnected     = "reconnected"
+	eventHandoverStarted = "handoverStarted"
+	eventCleanedUp       = "cleanedUp"
+)
+
+var allEvents = []string{eventConnected, eventStarted, eventProgress,
+	eventPaused, eventReconnected, eventHandoverStarted, eventCleanedUp}
+
+const (
+	// how many events may wait for delivery to one subscriber. When its
+	// queue is full, new events for it are dropped (we never block the upload
+	// for an event).
+	eventQueueSize = 1000
+
+	// longest wait between two delivery attempts
+	eventMaxBackoff = 60 * time.Second
+)
+
+// eventSub is a subscription to events: which events should be POSTed where,
+// and how often progress should be reported.
+type eventSub struct {
+	url             *url.URL
+	events          map[string]bool // nil: all events
+	progressPercent uint            // 0: no progress events by percentage
+	progressBytes   int64           // 0: no progress events by bytes
+}
+
+// newEventSub makes a subscription. events is a comma separated list of event
+// names (empty string: all events).
+func newEventSub(rawURL string, events string, progressPercent uint,
+	progressBytes int64) (*eventSub, error) {
+	s := new(eventSub)
+	var err error
+	s.url, err = url.ParseRequestURI(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if events != "" {
+		s.events = make(map[string]bool)
+		for _, e := range strings.Split(events, ",") {
+			e = strings.TrimSpace(e)
+			known := false
+			for _, a := range allEvents {
+				known = known || (e == a)
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown event '%s'", e)
+			}
+			s.events[e] = true
+		}
+	}
+	if progressPercent > 100 {
+		return nil, fmt.Errorf("progress percentage must be at most 100")
+	}
+	s.progressPercent = progressPercent
+	s.progressBytes = progressBytes
+	return s, nil
+}
+
+func (s *eventSub) wants(event string) bool {
+	return s.events == nil || s.events[event]
+}
+
+// progressMilestone returns a number that increases by one each time the
+// upload passes a progress milestone of the subscription
+func (s *eventSub) progressMilestone(pos, size int64) (m int64) {
+	if s.progressPercent > 0 && size > 0 {
+		m += pos * 100 / size / int64(s.progressPercent)
+	}
+	if s.progressBytes > 0 {
+		m += pos / s.progressBytes
+	}
+	return
+}
+
+// eventUpload is what the event dispatcher knows about an upload
+type eventUpload struct {
+	tenant        string
+	backendSecret string
+	sub           *eventSub // the ticket's own subscription, might be nil
+	seq           int
+
+	// last reported progress milestones, for the ticket's subscription and
+	// for the global one
+	ticketMilestone int64
+	globalMilestone int64
+}
+
+// event is one event on its way to one subscriber
+type event struct {
+	url  *url.URL
+	form url.Values
+}
+
+// eventQueue holds the events that wait for delivery to one subscriber URL.
+// The dispatcher's lock protects it.
+type eventQueue struct {
+	url    string
+	events []*event
+}
+
+// eventDispatcher delivers events to subscribers asynchronously: each
+// subscriber URL has a queue of its own, and a goroutine that POSTs the
+// events in it, retrying with exponential backoff if the subscriber doesn't
+// answer with 200. A subscriber that is down only holds up its own events.
+//
+// Subscriptions are per upload (made with the upload ticket) or global (from
+// the app config). An upload must be registered with the dispatcher to get
+// any events delivered.
+type eventDispatcher struct {
+	lock    sync.Mutex
+	uploads map[string]*eventUpload
+	queues  map[string]*eventQueue // by subscriber URL, only while not empty
+
+	// global subscription, and the app config it was made from
+	global       *eventSub
+	globalConfig *appConfigT
+}
+
+func newEventDispatcher() *eventDispatcher {
+	d := new(eventDispatcher)
+	d.uploads = make(map[string]*eventUpload)
+	d.queues = make(map[string]*eventQueue)
+	return d
+}
+
+// globalSub returns the global subscription from the app config, or nil if
+// there is none
+func (d *eventDispatcher) globalSub() *eventSub {
+	c := appVars.getConfig()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if c == d.globalConfig {
+		return d.global
+	}
+
+	// config has changed (or this is the first call)
+	d.globalConfig = c
+	d.global = nil
+	if c.EventURL != "" {
+		var err error
+		d.global, err = c.globalEventSub()
+		if err != nil { // validated when config was loaded, shouldn't happen
+			logging.Error("global event subscription is invalid", "err", err)
+		}
+	}
+	return d.global
+}
+
+// register makes the dispatcher deliver events for an upload. sub is the
+// ticket's own subscription and may be nil.
+func (d *eventDispatcher) register(uploader upload.Uploader, sub *eventSub) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.uploads[uploader.GetId()] = &eventUpload{
+		tenant:        uploader.GetTenant(),
+		backendSecret: uploader.GetBackendSecret(),
+		sub:           sub,
+	}
+}
+
+// emit sends an event about an upload to all its subscribers that want it.
+// extra holds event specific form values, and may be nil. emit never blocks.
+// After a cleanedUp event, the upload is unregistered.
+func (d *eventDispatcher) emit(id string, name string, extra url.Values) {
+	global := d.globalSub()
+
+	d.lock.Lock()
+	ul, ok := d.uploads[id]
+	if !ok {
+		d.lock.Unlock()
+		return
+	}
+	ul.seq++
+	seq := ul.seq
+	if name == eventCleanedUp {
+		delete(d.uploads, id)
+	}
+	d.lock.Unlock()
+
+	for _, sub := range []*eventSub{ul.sub, global} {
+		if sub == nil || !sub.wants(name) {
+			continue
+		}
+		form := url.Values{}
+		for k, v := range extra {
+			form[k] = v
+		}
+		form.Set("id", id)
+		form.Set("event", name)
+		form.Set("seq", strconv.Itoa(seq))
+		form.Set("time", time.Now().Format(time.RFC3339Nano))
+		form.Set("tenant", ul.tenant)
+		// the backend secret is only for the ticket's own subscriber, the
+		// global one might not belong to the upload's tenant
+		if sub == ul.sub {
+			form.Set("backendSecret", ul.backendSecret)
+		}
+
+		if !d.enqueue(&event{url: sub.url, form: form}) {
+			logging.Warn("event queue is full, dropping event", "upload", id,
+				"event", name, "url", sub.url.String())
+		}
+	}
+}
+
+// enqueue puts an event into the queue of its subscriber, and starts a
+// goroutine that delivers the queue's events if there is none. It returns
+// false if the queue is full.
+func (d *eventDispatcher) enqueue(e *event) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	q, ok := d.queues[e.url.String()]
+	if !ok {
+		q = &eventQueue{url: e.url.String()}
+		d.queues[q.url] = q
+		go d.goDeliver(q)
+	}
+	if len(q.events) >= eventQueueSize {
+		return false
+	}
+	q.events = append(q.events, e)
+	return true
+}
+
+// progress emits progress events for subscribers whose next milestone the
+// upload has passed. It is cheap if there is nothing to report.
+func (d *eventDispatcher) progress(id string, pos, size int64) {
+	global := d.globalSub()
+
+	d.lock.Lock()
+	ul, ok := d.uploads[id]
+	if !ok {
+		d.lock.Unlock()
+		return
+	}
+	report := false
+	if ul.sub != nil {
+		if m := ul.sub.progressMilestone(pos, size); m > ul.ticketMilestone {
+			ul.ticketMilestone = m
+			report = true
+		}
+	}
+	if global != nil {
+		if m := global.progressMilestone(pos, size); m > ul.globalMilestone {
+			ul.globalMilestone = m
+			report = true
+		}
+	}
+	d.lock.Unlock()
+
+	if report {
+		d.emit(id, eventProgress, url.Values{
+			"filePos":  {strconv.FormatInt(pos, 10)},
+			"fileSize": {strconv.FormatInt(size, 10)},
+		})
+	}
+}
+
+// goDeliver is a goroutine that delivers the events of a subscriber's queue,
+// in order, until the queue is empty. The queue is removed then.
+func (d *eventDispatcher) goDeliver(q *eventQueue) {
+	for {
+		d.lock.Lock()
+		if len(q.events) == 0 {
+			delete(d.queues, q.url)
+			d.lock.Unlock()
+			return
+		}
+		e := q.events[0]
+		q.events[0] = nil
+		q.events = q.events[1:]
+		d.lock.Unlock()
+
+		d.deliver(e)
+	}
+}
+
+// deliver POSTs an event to its subscriber, and retries with exponential
+// backoff until the subscriber answers with 200, or until we give up.
+func (d *eventDispatcher) deliver(e *event) {
+	c := appVars.getConfig()
+	htclient := new(http.Client)
+	htclient.Timeout = time.Duration(c.EventTimeoutS) * time.Second
+	backoff := time.Second
+
+	for attempt := uint(0); ; attempt++ {
+		resp, err := htclient.PostForm(e.url.String(), e.form)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				err = fmt.Errorf("got bad http status: %s", resp.Status)
+			}
+		}
+		if err == nil {
+			return
+		}
+		if attempt >= c.EventMaxRetries {
+			logging.Warn("giving up delivering event", "upload", e.form.Get("id"),
+				"event", e.form.Get("event"), "url", e.url.String(), "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > eventMaxBackoff {
+			backoff = eventMaxBackoff
+		}
+	}
+}
+
+// eventPool is an uploader pool that emits a cleanedUp event when an
+// uploader is removed from it (which happens in the uploader's CleanUp).
+type eventPool struct {
+	upload.UploaderPool
+}
+
+func (p eventPool) Remove(id string) {
+	p.UploaderPool.Remove(id)
+	appVars.events.emit(id, eventCleanedUp, nil)
+}
@@ -20,36 +20,215 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"bitbucket.org/kardianos/osext"
 	"github.com/gorilla/mux"
 
+	"github.com/uit-no/incoming/logging"
 	"github.com/uit-no/incoming/upload"
 )
 
 type appVarsT struct {
-	uploaders upload.UploaderPool
-	config    *appConfigT
+	uploaders   upload.UploaderPool
+	batches     *upload.BatchPool
+	deadLetters *upload.DeadLetterList
+	bandwidth   *bandwidthT
+	dedup       *upload.DedupStore // nil: no deduplication
+	encryption  *upload.Encryption // nil: files aren't encrypted
+	admission   *admissionT
+	events      *eventDispatcher
+
+	// config can be replaced at runtime (see ReloadConfig), so never access
+	// it directly, use getConfig and setConfig. The config object itself must
+	// not be modified once it is set.
+	configLock sync.RWMutex
+	config     *appConfigT
 }
 
 var appVars *appVarsT
 
+// getConfig returns the current app config
+func (a *appVarsT) getConfig() *appConfigT {
+	a.configLock.RLock()
+	defer a.configLock.RUnlock()
+	return a.config
+}
+
+// setConfig replaces the app config
+func (a *appVarsT) setConfig(c *appConfigT) {
+	a.configLock.Lock()
+	a.config = c
+	a.configLock.Unlock()
+}
+
 /* NewUploadHandler receives an http request from a webapp wanting to do
 an upload, and makes an Uploader for it. It responds with the uploader's id
 (string).
 */
 func NewUploadHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("got new upload request")
+	logging.Debug("got new upload request", "remote", clientIP(r))
 
 	// read upload parameters from request
+	params, ok := readTicketParams(w, r)
+	if !ok || !admitTicket(w, r, params.tenant, 1) {
+		return
+	}
+
+	// optional subscription to upload events
+	var eventSubscription *eventSub
+	if eventURL := r.FormValue("eventURL"); eventURL != "" {
+		progressPercent, err := strconv.ParseUint(
+			defaultStr(r.FormValue("eventProgressPercent"), "0"), 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "eventProgressPercent invalid: %s", err.Error())
+			return
+		}
+		progressBytes, err := strconv.ParseInt(
+			defaultStr(r.FormValue("eventProgressBytes"), "0"), 10, 64)
+		if err != nil || progressBytes < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "eventProgressBytes invalid: %v", err)
+			return
+		}
+		eventSubscription, err = newEventSub(eventURL, r.FormValue("events"),
+			uint(progressPercent), progressBytes)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "event subscription invalid: %s", err.Error())
+			return
+		}
+	}
+
+	// make (and pool) new uploader
+	uploader := upload.NewUploadToLocalFile(appVars.uploaders,
+		appVars.deadLetters, params.storageDir, params.signalFinishURL,
+		params.removeFileWhenFinished, params.backendSecret, params.tenant,
+		params.metadata, params.uploadConf)
+	appVars.events.register(uploader, eventSubscription)
+
+	// answer request with id of new uploader
+	fmt.Fprint(w, uploader.GetId())
+	return
+}
+
+/* NewBatchHandler receives an http request from a webapp wanting to do
+several uploads under one ticket, and makes a Batch for it. It responds with
+the batch's id (string).
+*/
+func NewBatchHandler(w http.ResponseWriter, r *http.Request) {
+	logging.Debug("got new batch request", "remote", clientIP(r))
+
+	// read the parameters every ticket has from request
+	params, ok := readTicketParams(w, r)
+	if !ok {
+		return
+	}
+	config := appVars.getConfig()
+
+	// how many files, and how many bytes altogether? The number of files
+	// must be given, the size defaults to the maximum.
+	maxFilesStr := r.FormValue("maxFiles")
+	if maxFilesStr == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "maxFiles not given")
+		return
+	}
+	maxFiles, err := parseBoundedUint(maxFilesStr, config.MaxBatchFiles)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "maxFiles invalid: %s", err.Error())
+		return
+	}
+	maxTotalBytes := int64(config.MaxBatchTotalMB) * 1024 * 1024
+	if maxTotalBytesStr := r.FormValue("maxTotalBytes"); maxTotalBytesStr != "" {
+		val, err := strconv.ParseInt(maxTotalBytesStr, 10, 64)
+		if err == nil && (val < 1 || (maxTotalBytes > 0 && val > maxTotalBytes)) {
+			err = fmt.Errorf("must be between 1 and %d", maxTotalBytes)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "maxTotalBytes invalid: %s", err.Error())
+			return
+		}
+		maxTotalBytes = val
+	}
+
+	// each file of the batch counts as a ticket
+	if !admitTicket(w, r, params.tenant, maxFiles) {
+		return
+	}
+
+	// optional URL to POST to when a single file is here
+	var fileSignalFinishURL *url.URL
+	if str := r.FormValue("fileSignalFinishURL"); str != "" {
+		fileSignalFinishURL, err = url.ParseRequestURI(str)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "fileSignalFinishURL invalid: %s", err.Error())
+			return
+		}
+	}
+
+	// make (and pool) new batch
+	batch := upload.NewBatch(appVars.batches, appVars.uploaders,
+		appVars.deadLetters, params.storageDir, params.signalFinishURL,
+		fileSignalFinishURL, params.removeFileWhenFinished,
+		params.backendSecret, params.tenant, params.metadata, int(maxFiles),
+		maxTotalBytes, params.uploadConf)
+
+	// answer request with id of new batch
+	fmt.Fprint(w, batch.GetId())
+}
+
+// admitTicket makes sure that we can issue a ticket for the given number of
+// files. If there are too many tickets already, it writes a response that
+// tells the client to try again later, and returns false.
+func admitTicket(w http.ResponseWriter, r *http.Request, tenant string,
+	files uint) bool {
+	if appVars.admission.canIssueTicket(files) {
+		return true
+	}
+	config := appVars.getConfig()
+	logging.Warn("too many upload tickets, turning away request",
+		"remote", clientIP(r), "tenant", tenant, "files", files)
+	w.Header().Set("Retry-After", strconv.Itoa(int(config.BusyRetryAfterS)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "busy, retry after %d seconds", config.BusyRetryAfterS)
+	return false
+}
+
+// ticketParams holds the request parameters that single upload tickets and
+// batch tickets have in common
+type ticketParams struct {
+	signalFinishURL        *url.URL
+	removeFileWhenFinished bool
+	backendSecret          string
+	tenant                 string
+	metadata               map[string]string
+	storageDir             string
+	uploadConf             upload.Config
+}
+
+// readTicketParams reads the parameters every ticket has from a request. If
+// something is wrong, it writes an error response and returns false.
+func readTicketParams(w http.ResponseWriter, r *http.Request) (*ticketParams,
+	bool) {
+	params := new(ticketParams)
 
 	// upload to file or... (nothing else supported yet)
 	destType := r.FormValue("destType") // 'file' or nothing. Default: file
@@ -58,11 +237,12 @@ func NewUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// which URL to POST to when file is here
-	signalFinishURL, err := url.ParseRequestURI(r.FormValue("signalFinishURL"))
+	var err error
+	params.signalFinishURL, err = url.ParseRequestURI(r.FormValue("signalFinishURL"))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "signalFinishURL invalid: %s", err.Error())
-		return
+		return nil, false
 	}
 
 	// should we remove the file when it's all over or not?
@@ -70,26 +250,154 @@ func NewUploadHandler(w http.ResponseWriter, r *http.Request) {
 	if removeFileWhenFinishedStr == "" { // true or false. Default: true
 		removeFileWhenFinishedStr = "true"
 	}
-	removeFileWhenFinished, err := strconv.ParseBool(removeFileWhenFinishedStr)
+	params.removeFileWhenFinished, err = strconv.ParseBool(removeFileWhenFinishedStr)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "removeFileWhenFinished invalid: %s", err.Error())
-		return
+		return nil, false
 	}
 
 	// secret cookie to POST to finish URL later
-	backendSecret := r.FormValue("backendSecret") // optional, "" if not given
+	params.backendSecret = r.FormValue("backendSecret") // optional, "" if not given
 
-	// make (and pool) new uploader
-	storageDirAbsolute, _ := filepath.Abs(appVars.config.StorageDir)
-	uploader := upload.NewUploadToLocalFile(appVars.uploaders,
-		storageDirAbsolute, signalFinishURL,
-		removeFileWhenFinished, backendSecret,
-		time.Duration(appVars.config.UploadMaxIdleDurationS)*time.Second)
+	// should the upload pick up config changes when the app config is
+	// reloaded?
+	reloadableConfigStr := r.FormValue("reloadableConfig")
+	if reloadableConfigStr == "" { // true or false. Default: false
+		reloadableConfigStr = "false"
+	}
+	reloadableConfig, err := strconv.ParseBool(reloadableConfigStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "reloadableConfig invalid: %s", err.Error())
+		return nil, false
+	}
 
-	// answer request with id of new uploader
-	fmt.Fprint(w, uploader.GetId())
-	return
+	// which tenant (app backend) is this upload for? Default: the host that
+	// asks for the ticket
+	params.tenant = r.FormValue("tenant")
+	if params.tenant == "" {
+		params.tenant = clientIP(r)
+	}
+
+	config := appVars.getConfig()
+
+	// optional metadata, which we pass on to the app backend later
+	params.metadata, err = readMetadata(r, config.MaxMetadataBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "metadata invalid: %s", err.Error())
+		return nil, false
+	}
+
+	// optional overrides of the default chunk size, send-ahead and timeouts,
+	// bounded by the maximums in the app config
+	var overrides upload.ConfigOverrides
+	var idleTimeoutS, pausedTimeoutS, handoverTimeoutS, handoverConfirmTimeoutS uint
+	boundedParams := []struct {
+		name string
+		max  uint
+		val  *uint
+	}{
+		{"chunkSizeKB", config.MaxUploadChunkSizeKB, &overrides.ChunkSizeKB},
+		{"sendAhead", config.MaxUploadSendAhead, &overrides.SendAhead},
+		{"idleTimeoutS", config.MaxUploadMaxIdleDurationS, &idleTimeoutS},
+		{"pausedTimeoutS", config.MaxUploadMaxPausedDurationS, &pausedTimeoutS},
+		{"handoverTimeoutS", config.MaxHandoverTimeoutS, &handoverTimeoutS},
+		{"handoverConfirmTimeoutS", config.MaxHandoverConfirmTimeoutS,
+			&handoverConfirmTimeoutS},
+	}
+	for _, p := range boundedParams {
+		str := r.FormValue(p.name)
+		if p.val == &pausedTimeoutS && str == "0" {
+			// forever, but only if that is how long uploads may be paused by
+			// default anyway
+			if config.UploadMaxPausedDurationS != 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "%s invalid: 0 (forever) is not allowed on "+
+					"this server", p.name)
+				return nil, false
+			}
+			overrides.PausedTimeout = upload.NoTimeout
+			continue
+		}
+		*p.val, err = parseBoundedUint(str, p.max)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s invalid: %s", p.name, err.Error())
+			return nil, false
+		}
+	}
+	overrides.IdleTimeout = time.Duration(idleTimeoutS) * time.Second
+	if pausedTimeoutS > 0 {
+		overrides.PausedTimeout = time.Duration(pausedTimeoutS) * time.Second
+	}
+	overrides.HandoverTimeout = time.Duration(handoverTimeoutS) * time.Second
+	overrides.HandoverConfirmTimeout =
+		time.Duration(handoverConfirmTimeoutS) * time.Second
+
+	params.uploadConf = overrides.Apply(config.uploadConfig())
+	params.uploadConf.Reloadable = reloadableConfig
+	params.storageDir, _ = filepath.Abs(config.StorageDir)
+	return params, true
+}
+
+// readMetadata reads the metadata fields (see upload.MetadataPrefix) from a
+// request. Keys and values together must not be longer than maxBytes. It
+// returns nil if there are none.
+func readMetadata(r *http.Request, maxBytes uint) (map[string]string, error) {
+	var metadata map[string]string
+	size := 0
+	for field, values := range r.Form {
+		if !strings.HasPrefix(field, upload.MetadataPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(field, upload.MetadataPrefix)
+		if key == "" {
+			return nil, fmt.Errorf("key missing in %q", field)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%q given more than once", field)
+		}
+		size += len(key) + len(values[0])
+		if size > int(maxBytes) {
+			return nil, fmt.Errorf("more than %d bytes", maxBytes)
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[key] = values[0]
+	}
+	return metadata, nil
+}
+
+// defaultStr returns s, or def if s is empty
+func defaultStr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// parseBoundedUint parses an optional unsigned integer request parameter. If
+// the parameter is not given (empty string), it returns 0. Otherwise, the
+// value must be between 1 and max. If max is 0, the parameter must not be
+// given at all.
+func parseBoundedUint(str string, max uint) (uint, error) {
+	if str == "" {
+		return 0, nil
+	}
+	val, err := strconv.ParseUint(str, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if max == 0 {
+		return 0, fmt.Errorf("can't be set on this server")
+	}
+	if val < 1 || val > uint64(max) {
+		return 0, fmt.Errorf("must be between 1 and %d", max)
+	}
+	return uint(val), nil
 }
 
 func ServeJSFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -108,6 +416,10 @@ func FinishUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	uploader, ok := appVars.uploaders.Get(id)
 	if !ok {
+		if batch, ok := appVars.batches.Get(id); ok {
+			finishBatch(w, r, batch)
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "id unknown")
 		return
@@ -122,7 +434,14 @@ func FinishUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// tell uploader that handover is done
+	ullog := uploadLog(uploader, r)
 	err := uploader.HandoverDone()
+	if err != nil {
+		ullog.Warn("backend signals finished handover, but uploader says no",
+			"err", err)
+	} else {
+		ullog.Info("backend signals finished handover")
+	}
 
 	// return error message or "ok"
 	if err != nil {
@@ -133,6 +452,177 @@ func FinishUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// PauseUploadHandler lets the app backend pause an upload. The browser is told
+// to stop sending, and why.
+func PauseUploadHandler(w http.ResponseWriter, r *http.Request) {
+	uploader, ok := backendUploader(w, r)
+	if !ok {
+		return
+	}
+
+	reason := defaultStr(r.FormValue("reason"), "paused by server")
+	err := uploader.PauseByServer(reason)
+	if err != nil {
+		uploadLog(uploader, r).Warn("couldn't pause upload", "err", err)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	appVars.events.emit(uploader.GetId(), eventPaused, nil)
+	fmt.Fprint(w, "ok")
+}
+
+// ResumeUploadHandler lets the app backend resume an upload it has paused
+func ResumeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	uploader, ok := backendUploader(w, r)
+	if !ok {
+		return
+	}
+
+	err := uploader.ResumeByServer()
+	if err != nil {
+		uploadLog(uploader, r).Warn("couldn't resume upload", "err", err)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// backendUploader fetches the uploader a backend request is about, and checks
+// the request's backend secret. If that doesn't work out, it writes an error
+// response and returns false.
+func backendUploader(w http.ResponseWriter, r *http.Request) (upload.Uploader, bool) {
+	// fetch uploader for given id
+	id := r.FormValue("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "id not given")
+		return nil, false
+	}
+	uploader, ok := appVars.uploaders.Get(id)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "id unknown")
+		return nil, false
+	}
+
+	// assert that 'backend secret string' matches (if it's not given, it's an
+	// empty string, which might be just fine)
+	if uploader.GetBackendSecret() != r.FormValue("backendSecret") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "backendSecret not given or wrong")
+		return nil, false
+	}
+	return uploader, true
+}
+
+// HandoverStatusHandler lets the app backend report how far it has come
+// processing a file that was handed over to it (after it answered "wait").
+// The report is passed on to the browser, and gives the backend more time to
+// confirm the handover.
+func HandoverStatusHandler(w http.ResponseWriter, r *http.Request) {
+	uploader, ok := backendUploader(w, r)
+	if !ok {
+		return
+	}
+
+	// progress is optional, and between 0 and 1
+	status := upload.HandoverStatus{Progress: -1, Text: r.FormValue("status")}
+	if progressStr := r.FormValue("progress"); progressStr != "" {
+		progress, err := strconv.ParseFloat(progressStr, 64)
+		if err != nil || progress < 0 || progress > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "progress invalid: must be a number between 0 and 1")
+			return
+		}
+		status.Progress = progress
+	}
+
+	err := uploader.SetHandoverStatus(status)
+	if err != nil {
+		uploadLog(uploader, r).Warn("backend reports handover status, but "+
+			"uploader says no", "err", err)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// uploadStatus is what UploadStatusHandler returns (JSON encoded)
+type uploadStatus struct {
+	Id        string
+	Tenant    string
+	State     string
+	FileName  string
+	FileSize  int64
+	FilePos   int64
+	Connected bool
+	Bandwidth rateInfo
+
+	// what the app backend has reported while processing the file
+	HandoverProgress float64
+	HandoverStatus   string
+
+	// whether we scan the file before handover right now
+	Scanning bool
+
+	// whether the upload is paused by the server, and why
+	PausedByServer bool
+	PauseReason    string
+
+	// metadata from the ticket
+	Metadata map[string]string
+}
+
+// UploadStatusHandler returns the status of an upload to the app backend
+func UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// fetch uploader for given id
+	id := r.FormValue("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "id not given")
+		return
+	}
+	uploader, ok := appVars.uploaders.Get(id)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "id unknown")
+		return
+	}
+
+	// assert that 'backend secret string' matches (if it's not given, it's an
+	// empty string, which might be just fine)
+	if uploader.GetBackendSecret() != r.FormValue("backendSecret") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "backendSecret not given or wrong")
+		return
+	}
+
+	status := uploadStatus{
+		Id:       id,
+		Tenant:   uploader.GetTenant(),
+		State:    upload.StateName(uploader.GetState()),
+		FileName: uploader.GetFileName(),
+		FileSize: uploader.GetFileSize(),
+		FilePos:  uploader.GetFilePos(),
+		Metadata: uploader.GetMetadata(),
+	}
+	handoverStatus := uploader.GetHandoverStatus()
+	status.HandoverProgress = handoverStatus.Progress
+	status.HandoverStatus = handoverStatus.Text
+	status.Scanning = handoverStatus.Scanning
+	status.PausedByServer, status.PauseReason = uploader.GetServerPause()
+	if l := appVars.bandwidth.upload(id); l != nil {
+		status.Connected = true
+		status.Bandwidth = newRateInfo(l)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
 func CancelUploadHandler(w http.ResponseWriter, r *http.Request) {
 	// fetch uploader for given id
 	id := r.FormValue("id")
@@ -143,6 +633,10 @@ func CancelUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	uploader, ok := appVars.uploaders.Get(id)
 	if !ok {
+		if batch, ok := appVars.batches.Get(id); ok {
+			cancelBatch(w, r, batch)
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(w, "id unknown")
 		return
@@ -157,8 +651,13 @@ func CancelUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// let uploader cancel
+	ullog := uploadLog(uploader, r)
+	ullog.Info("backend cancels upload")
 	err := uploader.Cancel(false, "Cancelled by request",
-		time.Duration(appVars.config.HandoverTimeoutS)*time.Second)
+		uploader.GetConfig().HandoverTimeout)
+	if err != nil {
+		ullog.Warn("couldn't cancel upload", "err", err)
+	}
 
 	// on success, clean up and return "ok". On failure, return error message
 	if err == nil {
@@ -172,47 +671,344 @@ func CancelUploadHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// finishBatch is FinishUploadHandler for batches
+func finishBatch(w http.ResponseWriter, r *http.Request, batch *upload.Batch) {
+	if batch.GetBackendSecret() != r.FormValue("backendSecret") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "backendSecret not given or wrong")
+		return
+	}
+
+	bLog := batchLog(batch, r)
+	err := batch.HandoverDone()
+	if err != nil {
+		bLog.Warn("backend signals finished handover, but batch says no",
+			"err", err)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	bLog.Info("backend signals finished handover")
+	fmt.Fprint(w, "ok")
+}
+
+// cancelBatch is CancelUploadHandler for batches
+func cancelBatch(w http.ResponseWriter, r *http.Request, batch *upload.Batch) {
+	if batch.GetBackendSecret() != r.FormValue("backendSecret") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "backendSecret not given or wrong")
+		return
+	}
+
+	bLog := batchLog(batch, r)
+	bLog.Info("backend cancels batch")
+	err := batch.Cancel("Cancelled by request")
+	if err != nil {
+		bLog.Warn("couldn't cancel batch", "err", err)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// ReloadConfigHandler lets an admin reload the app config (same as sending
+// SIGHUP to the process).
+func ReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminSecret(w, r) {
+		return
+	}
+
+	err := ReloadConfig()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "couldn't reload config: %s", err.Error())
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// MetricsHandler reports a few numbers about the whole server to an admin, in
+// a plain text format that monitoring systems (for example Prometheus)
+// understand.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminSecret(w, r) {
+		return
+	}
+
+	global, tenants := appVars.bandwidth.rates()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "incoming_uploads %d\n", appVars.uploaders.Size())
+	fmt.Fprintf(w, "incoming_batches %d\n", appVars.batches.Size())
+	fmt.Fprintf(w, "incoming_active_uploads %d\n",
+		appVars.admission.getActiveUploads())
+	fmt.Fprintf(w, "incoming_dead_letters %d\n", appVars.deadLetters.Size())
+	fmt.Fprintf(w, "incoming_rate_bytes_per_second{scope=\"global\"} %f\n",
+		global.RateBytesPerS)
+	fmt.Fprintf(w, "incoming_rate_limit_bytes_per_second{scope=\"global\"} %d\n",
+		global.LimitBytesPerS)
+	for name, t := range tenants {
+		fmt.Fprintf(w, "incoming_rate_bytes_per_second{scope=\"tenant\",tenant=%q} %f\n",
+			name, t.RateBytesPerS)
+		fmt.Fprintf(w, "incoming_rate_limit_bytes_per_second{scope=\"tenant\",tenant=%q} %d\n",
+			name, t.LimitBytesPerS)
+	}
+}
+
+// DeadLettersHandler lists all handovers that failed for good (JSON encoded)
+func DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminSecret(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appVars.deadLetters.GetAll())
+}
+
+// ReplayDeadLetterHandler lets an admin try a failed handover again
+func ReplayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminSecret(w, r) {
+		return
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "id not given")
+		return
+	}
+
+	handoverTimeout := time.Duration(appVars.getConfig().HandoverTimeoutS) * time.Second
+	err := appVars.deadLetters.Replay(id, handoverTimeout)
+	if err != nil {
+		logging.Warn("couldn't replay handover", "upload", id, "err", err)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "couldn't replay handover: %s", err.Error())
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// DeleteDeadLetterHandler lets an admin give up on a failed handover. The
+// dead letter and its file are removed.
+func DeleteDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminSecret(w, r) {
+		return
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "id not given")
+		return
+	}
+
+	err := appVars.deadLetters.Delete(id)
+	if err != nil {
+		logging.Warn("couldn't delete dead letter", "upload", id, "err", err)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, "couldn't delete dead letter: %s", err.Error())
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// checkAdminSecret makes sure that an admin request carries the admin secret
+// from the app config. If it doesn't, or if there is no admin secret
+// configured (in which case admin functions are disabled), checkAdminSecret
+// writes an error response and returns false.
+func checkAdminSecret(w http.ResponseWriter, r *http.Request) bool {
+	adminSecret := appVars.getConfig().AdminSecret
+	if adminSecret == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "admin functions are disabled")
+		return false
+	}
+	if adminSecret != r.FormValue("adminSecret") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "adminSecret not given or wrong")
+		return false
+	}
+	return true
+}
+
+// batchLog returns a logger whose lines carry batch id and tenant of the
+// given batch, and the address of the client that sent the request.
+func batchLog(batch *upload.Batch, r *http.Request) *logging.Logger {
+	return logging.With("batch", batch.GetId(), "tenant", batch.GetTenant(),
+		"remote", clientIP(r))
+}
+
+// uploadLog returns a logger whose lines carry upload id, tenant and state of
+// the given upload, and the address of the client that sent the request.
+func uploadLog(uploader upload.Uploader, r *http.Request) *logging.Logger {
+	return logging.With("upload", uploader.GetId(),
+		"tenant", uploader.GetTenant(), "remote", clientIP(r),
+		"state", logging.Lazy(func() interface{} {
+			return upload.StateName(uploader.GetState())
+		}))
+}
+
+// statusRecorder is a ResponseWriter that remembers the status code that was
+// written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// accessLog wraps an http handler, and logs each request to the backend and
+// admin APIs if the app config says so.
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !appVars.getConfig().AccessLog ||
+			!(strings.HasPrefix(r.URL.Path, "/incoming/0.1/backend/") ||
+				strings.HasPrefix(r.URL.Path, "/incoming/0.1/admin/")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+		logging.Info("access", "remote", clientIP(r), "method", r.Method,
+			"path", r.URL.Path, "upload", r.FormValue("id"),
+			"status", rec.status,
+			"durationMs", time.Since(start).Nanoseconds()/int64(time.Millisecond))
+	})
+}
+
+// handleSignals reloads the app config whenever we get SIGHUP
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		logging.Info("got SIGHUP, reloading config")
+		err := ReloadConfig()
+		if err != nil {
+			logging.Error("couldn't reload config, keeping the old one",
+				"err", err)
+		}
+	}
+}
+
+// pruneDedupStore removes files that haven't been used for a while from the
+// dedup store, every now and then
+func pruneDedupStore() {
+	for range time.Tick(time.Hour) {
+		retain := appVars.getConfig().DedupRetainS
+		if retain > 0 {
+			appVars.dedup.Prune(time.Duration(retain) * time.Second)
+		}
+	}
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
 	// --- init application-wide things (config, data structures)
 	appVars = new(appVarsT)
-	var err error
 
 	// load config
-	appVars.config, err = LoadConfig()
+	config, err := LoadConfig()
 	if err != nil {
-		log.Printf("Couldn't load config!")
-		log.Fatal(err)
+		logging.Error("couldn't load config!", "err", err)
+		os.Exit(1)
 		return
 	}
+	appVars.setConfig(config)
+	config.configureLogging()
+	appVars.bandwidth = newBandwidth(config)
+	appVars.admission = newAdmission()
 
 	// init upload module
-	err = upload.InitModule(appVars.config.StorageDir)
+	err = upload.InitModule(config.StorageDir)
 	if err != nil {
-		log.Fatal(err)
+		logging.Error("couldn't init upload module", "err", err)
+		os.Exit(1)
 		return
 	}
 
-	// init uploader pool
-	appVars.uploaders = upload.NewLockedUploaderPool()
+	// init uploader pool, and event dispatcher (which needs to know when
+	// uploaders leave the pool)
+	appVars.events = newEventDispatcher()
+	appVars.uploaders = eventPool{upload.NewLockedUploaderPool()}
+	appVars.batches = upload.NewBatchPool()
+	appVars.deadLetters = upload.NewDeadLetterList()
+
+	// set up encryption of files at rest (the config is valid, so this
+	// works)
+	appVars.encryption, _ = config.encryption()
+
+	// open the dedup store, if we have one
+	if config.DedupDir != "" {
+		appVars.dedup, err = upload.NewDedupStore(config.DedupDir)
+		if err != nil {
+			logging.Error("couldn't open dedup store", "dir", config.DedupDir,
+				"err", err)
+			os.Exit(1)
+			return
+		}
+		go pruneDedupStore()
+	}
+
+	// take up the uploads that were running when we were shut down. Browsers
+	// resume them when they reconnect.
+	storageDir, _ := filepath.Abs(config.StorageDir)
+	recovered := upload.RecoverUploads(appVars.uploaders, appVars.deadLetters,
+		storageDir, config.uploadConfig())
+	for _, uploader := range recovered {
+		appVars.events.register(uploader, nil)
+	}
+	if len(recovered) > 0 {
+		logging.Info("recovered uploads", "count", len(recovered))
+	}
+
+	// reload config on SIGHUP
+	go handleSignals()
 
 	// --- set up http server
 	routes := mux.NewRouter()
 	routes.HandleFunc("/incoming/0.1/backend/new_upload", NewUploadHandler).
 		Methods("POST")
+	routes.HandleFunc("/incoming/0.1/backend/new_batch", NewBatchHandler).
+		Methods("POST")
 	routes.HandleFunc("/incoming/0.1/backend/cancel_upload", CancelUploadHandler).
 		Methods("POST")
 	routes.HandleFunc("/incoming/0.1/backend/finish_upload", FinishUploadHandler).
 		Methods("POST")
+	routes.HandleFunc("/incoming/0.1/backend/upload_status", UploadStatusHandler).
+		Methods("POST")
+	routes.HandleFunc("/incoming/0.1/backend/handover_status",
+		HandoverStatusHandler).Methods("POST")
+	routes.HandleFunc("/incoming/0.1/backend/pause_upload", PauseUploadHandler).
+		Methods("POST")
+	routes.HandleFunc("/incoming/0.1/backend/resume_upload", ResumeUploadHandler).
+		Methods("POST")
+	routes.HandleFunc("/incoming/0.1/admin/reload_config", ReloadConfigHandler).
+		Methods("POST")
+	routes.HandleFunc("/incoming/0.1/admin/metrics", MetricsHandler).
+		Methods("GET", "POST")
+	routes.HandleFunc("/incoming/0.1/admin/dead_letters", DeadLettersHandler).
+		Methods("GET", "POST")
+	routes.HandleFunc("/incoming/0.1/admin/replay_dead_letter",
+		ReplayDeadLetterHandler).Methods("POST")
+	routes.HandleFunc("/incoming/0.1/admin/delete_dead_letter",
+		DeleteDeadLetterHandler).Methods("POST")
 	routes.HandleFunc("/incoming/0.1/frontend/upload_ws", websocketHandler).
 		Methods("GET")
 	routes.HandleFunc("/incoming/0.1/frontend/incoming.js", ServeJSFileHandler).
 		Methods("GET")
 
 	// --- run server forever
-	serverHost := fmt.Sprintf("%s:%d", appVars.config.IncomingIP,
-		appVars.config.IncomingPort)
-	log.Printf("Will start server on %s", serverHost)
-	log.Fatal(http.ListenAndServe(serverHost, routes))
+	serverHost := fmt.Sprintf("%s:%d", config.IncomingIP,
+		config.IncomingPort)
+	logging.Info("will start server", "host", serverHost)
+	err = http.ListenAndServe(serverHost, accessLog(routes))
+	logging.Error("server terminated", "err", err)
+	os.Exit(1)
 }
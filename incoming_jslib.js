@@ -31,13 +31,26 @@ _incoming_lib = function() {
         server_hostname = hostname;
     };
 
-    var msgUploadReq = function msgUploadReq(upload_id, length_bytes, name) {
+    var msgUploadReq = function msgUploadReq(upload_id, length_bytes, name,
+                                             batch_index, batch_file_count,
+                                             relative_path, range_start,
+                                             range_end, sha256, compression,
+                                             mime_type, last_modified) {
         var msg = {
             MsgType: "MsgUploadReq",
             MsgData : {
                 Id: upload_id,
                 LengthBytes: length_bytes,
-                Name: name
+                Name: name,
+                BatchIndex: batch_index,
+                BatchFileCount: batch_file_count,
+                RelativePath: relative_path,
+                RangeStart: range_start,
+                RangeEnd: range_end,
+                Sha256: sha256 || "",
+                Compression: compression,
+                MimeType: mime_type || "",
+                LastModified: last_modified || 0
             }
         };
         return JSON.stringify(msg);
@@ -73,6 +86,16 @@ _incoming_lib = function() {
         return JSON.stringify(msg);
     };
 
+    var msgSeek = function msgSeek(file_pos) {
+        var msg = {
+            MsgType: "MsgSeek",
+            MsgData: {
+                FilePos: file_pos
+            }
+        };
+        return JSON.stringify(msg);
+    };
+
     var msgCancel = function msgCancel(reason) {
         var msg = {
             MsgType: "MsgCancel",
@@ -94,8 +117,33 @@ _incoming_lib = function() {
         return JSON.stringify(msg);
     };
 
-    incoming_lib.Uploader = function Uploader(upload_id, file) {
+    // For a file of a batch, upload_id is the batch id, and batch_index and
+    // batch_file_count say which of how many files of the batch this is
+    // (batch_index counts from 0). Both can be left out for single uploads.
+    // Files of a batch that come from a folder upload keep their path within
+    // the folder (webkitRelativePath), unless relative_path says otherwise.
+    incoming_lib.Uploader = function Uploader(upload_id, file, batch_index,
+                                              batch_file_count, relative_path) {
+        return make_uploader(upload_id, file, {
+            batch_index: batch_index || 0,
+            batch_file_count: batch_file_count || 0,
+            relative_path: relative_path,
+            range_start: 0,
+            range_end: 0
+        });
+    };
+
+    // make_uploader makes an uploader for a file, or for the range of it
+    // from opts.range_start up to (but not including) opts.range_end if
+    // opts.range_end isn't 0. In that case, all byte counts of the uploader
+    // are for the range.
+    var make_uploader = function make_uploader(upload_id, file, opts) {
         var ul = {};
+        var batch_index = opts.batch_index;
+        var batch_file_count = opts.batch_file_count;
+        var relative_path = opts.relative_path;
+        var range_start = opts.range_start;
+        var range_end = opts.range_end;
 
         var ws = null; // WebSocket - opened in start()
         var file_reader = new FileReader();
@@ -103,13 +151,37 @@ _incoming_lib = function() {
                                 // FilePos (for resume), SendAhead.
                                 // Set in start()
         var conn_retry = null;
+        var missing = []; // ranges of the file the server doesn't have yet,
+                          // from upload_conf.MissingRanges. We send them one
+                          // after the other, and drop each once it is sent.
+        var send_pos = 0; // where in the file the next chunk starts
+        var load_pos = null; // where the chunk that file_reader loads starts
+        var compressing = false; // is a chunk being compressed right now?
         ul.filename = file.name;
+        ul.relative_path = ""; // where the file goes within a batch
+        if (batch_file_count) {
+            ul.relative_path = relative_path || file.webkitRelativePath || "";
+        }
         ul.chunks_tx_now = 0; // "now" because upload could have been resumed
         ul.chunks_acked_now = 0; // "now" because upload could have been resumed
         ul.bytes_tx = 0; // bytes sent over websocket
         ul.bytes_acked = 0; // bytes acknowledged by incoming backend
         ul.bytes_total = file.size;
+        if (range_end > 0) {
+            ul.bytes_total = range_end - range_start;
+        }
+        ul.range_done = false; // our range is uploaded, but not the whole file
+        ul.sha256 = null; // SHA-256 hash of the file (hex), if known. Set it
+                          // before start() to let the server skip the upload
+                          // if it has the file already.
+        ul.compress = false; // compress file chunks before sending them, if
+                             // the browser and the server can? Set it before
+                             // start().
         ul.frac_complete = 0.0;
+        ul.handover_frac_complete = null; // reported by web app backend,
+                                          // null if unknown
+        ul.handover_status = null;
+        ul.scanning = false; // true while the server scans the file
         ul.finished = false;
         ul.cancelled = false;
         ul.cancelling = false;
@@ -117,6 +189,7 @@ _incoming_lib = function() {
         ul.can_pause = false;
         ul.connected = false;
         ul.paused = false;
+        ul.paused_by_server = false;
         ul.chunks_ahead = 0; // how many chunks have been sent without
                              // having gotten acknowledgement from incoming
                              // (upload_conf.SendAhead is upper limit for this)
@@ -125,6 +198,7 @@ _incoming_lib = function() {
         ul.error_code = null; // set only in case of error
         ul.error_msg = null;
         ul.cancel_msg = null;
+        ul.pause_msg = null; // why the server has paused the upload
         ul.state_msg = "not yet started"; // purely informal, human readable state
                                           // information
 
@@ -134,6 +208,31 @@ _incoming_lib = function() {
         ul.onfinished = function(o){};
         ul.oncancelled = function(o){};
         ul.onerror = function(o){};
+        ul.onrangedone = function(o){};
+
+        // compression_methods returns the compression methods we can use for
+        // file chunks
+        var compression_methods = function compression_methods() {
+            if (ul.compress && typeof CompressionStream != "undefined") {
+                return ["deflate-raw"];
+            }
+            return [];
+        };
+
+        // set_missing sets us up for sending the ranges the server says it
+        // doesn't have yet. All the rest is acked.
+        var set_missing = function set_missing(ranges) {
+            missing = (ranges || []).slice();
+            ul.bytes_acked = ul.bytes_total;
+            for (var i = 0; i < missing.length; i++) {
+                ul.bytes_acked -= missing[i].End - missing[i].Start;
+            }
+            ul.bytes_tx = ul.bytes_acked;
+            ul.frac_complete = ul.bytes_acked / ul.bytes_total;
+            if (missing.length > 0) {
+                send_pos = missing[0].Start;
+            }
+        };
 
         // try_load_and_send_file_chunk is the function we call when we want to
         // send chunks. It makes file_reader load a chunk from the file. When
@@ -149,15 +248,17 @@ _incoming_lib = function() {
         var try_load_and_send_file_chunk = function try_load_and_send_file_chunk() {
             // are we clear to transfer more right now? if yes, make
             // file_reader load (and in onloadend send) the next chunk
-            if (ul.chunks_ahead < upload_conf.SendAhead && 
+            if (ws !== null && ws.onmessage === receive_chunk_acks &&
+                    ul.chunks_ahead < upload_conf.SendAhead && 
                     file_reader.readyState != FileReader.LOADING &&
-                    ul.bytes_tx < ul.bytes_total &&
-                    !ul.cancelling) {
-                var end = ul.bytes_tx + (upload_conf.ChunkSizeKB*1024);
-                if (end > ul.bytes_total) {
-                    end = ul.bytes_total;
+                    !compressing && missing.length > 0 &&
+                    !ul.cancelling && !ul.paused_by_server) {
+                var end = send_pos + (upload_conf.ChunkSizeKB*1024);
+                if (end > missing[0].End) {
+                    end = missing[0].End;
                 }
-                var blob = file.slice(ul.bytes_tx, end);
+                load_pos = send_pos;
+                var blob = file.slice(send_pos, end);
                 file_reader.readAsArrayBuffer(blob);
             }
         };
@@ -168,37 +269,98 @@ _incoming_lib = function() {
         file_reader.onload = function onload(evt) {
             if (evt.target.readyState == FileReader.DONE &&
                     evt.target.result != null &&
-                    !ul.cancelling && !ul.cancelled && !ul.paused) {
-                // send chunk if websocket is open
-                if (ws.readyState == WebSocket.OPEN) {
-                    buf = evt.target.result;
-                    ws.send(buf);
-
-                    // update state
-                    ul.bytes_tx += buf.byteLength;
-                    ul.bytes_ahead += buf.byteLength;
-                    ul.chunks_tx_now += 1;
-                    ul.chunks_ahead += 1;
-
-                    // if this was the last chunk, we can no longer
-                    // cancel or pause
-                    if (ul.bytes_tx == ul.bytes_total) {
-                        ul.can_cancel = false;
-                        ul.can_pause = false;
-                    }
-
-                    // call progress cb
-                    ul.onprogress(ul);
-
-                    // try to load&send another chunk
+                    !ul.cancelling && !ul.cancelled && !ul.paused &&
+                    !ul.paused_by_server) {
+                // a chunk from before a resume doesn't belong where we
+                // are now
+                if (load_pos != send_pos) {
                     try_load_and_send_file_chunk();
+                    return;
+                }
+                var buf = evt.target.result;
+                if (!upload_conf.Compression) {
+                    send_chunk(buf, buf, ws);
+                    return;
                 }
+
+                // compress the chunk first if the server wants us to. We
+                // don't load the next chunk until this one is sent.
+                var sock = ws;
+                compressing = true;
+                compress_chunk(buf).then(function compressed(wire_buf) {
+                    compressing = false;
+                    send_chunk(buf, wire_buf, sock);
+                }, function compress_failed(err) {
+                    compressing = false;
+                    if (!ul.cancelled) {
+                        ul.cancel("couldn't compress file chunk: " + err);
+                    }
+                });
             } else {
-                if (!ul.cancelling && !ul.cancelled && !ul.paused) {
+                if (!ul.cancelling && !ul.cancelled && !ul.paused &&
+                        !ul.paused_by_server) {
                     ul.cancel("unexpected file_reader.onloadend error");
                 }
             }
         };
+
+        // compress_chunk compresses a file chunk as the server wants it, and
+        // returns a promise of the compressed chunk
+        var compress_chunk = function compress_chunk(buf) {
+            var stream = new Blob([buf]).stream().pipeThrough(
+                new CompressionStream(upload_conf.Compression));
+            return new Response(stream).arrayBuffer();
+        };
+
+        // send_chunk sends the file chunk buf (as wire_buf, which is buf
+        // itself or buf compressed) over the websocket sock, then tries to
+        // load&send another chunk. If we have moved on in the meantime
+        // (another connection, pause, cancel), the chunk isn't sent.
+        var send_chunk = function send_chunk(buf, wire_buf, sock) {
+            if (ul.cancelling || ul.cancelled || ul.paused ||
+                    ul.paused_by_server) {
+                return;
+            }
+            if (load_pos != send_pos || sock !== ws) {
+                try_load_and_send_file_chunk();
+                return;
+            }
+            // send chunk if websocket is open
+            if (ws.readyState == WebSocket.OPEN) {
+                ws.send(wire_buf);
+
+                // update state
+                ul.bytes_tx += buf.byteLength;
+                ul.bytes_ahead += buf.byteLength;
+                ul.chunks_tx_now += 1;
+                ul.chunks_ahead += 1;
+
+                // on to the next missing range if this one is sent.
+                // It doesn't start where this one ends, so tell the
+                // server.
+                send_pos += buf.byteLength;
+                if (send_pos >= missing[0].End) {
+                    missing.shift();
+                    if (missing.length > 0) {
+                        send_pos = missing[0].Start;
+                        ws.send(msgSeek(send_pos));
+                    }
+                }
+
+                // if this was the last chunk, we can no longer
+                // cancel or pause
+                if (missing.length == 0) {
+                    ul.can_cancel = false;
+                    ul.can_pause = false;
+                }
+
+                // call progress cb
+                ul.onprogress(ul);
+
+                // try to load&send another chunk
+                try_load_and_send_file_chunk();
+            }
+        };
         file_reader.onerror = function onerror(evt) {
             if (!ul.cancelled) {
                 ul.cancel("error on file load: " + evt.name + " " + evt.message);
@@ -233,6 +395,32 @@ _incoming_lib = function() {
                 // call progress cb
                 ul.onprogress(ul);
 
+            } else if (obj.MsgType == "MsgServerPause") {
+                if (obj.MsgData.Pause) {
+                    // stop sending. The server throws away what we have
+                    // sent but what it hasn't acked yet.
+                    file_reader.abort();
+                    server_pause(obj.MsgData.Reason);
+                } else {
+                    // tell the server that we know, and carry on from where
+                    // it wants us to
+                    ul.paused_by_server = false;
+                    ul.pause_msg = null;
+                    set_missing(obj.MsgData.MissingRanges);
+                    ul.chunks_ahead = 0;
+                    ul.bytes_ahead = 0;
+                    ul.can_cancel = true;
+                    ul.state_msg = "transfer file chunks to upload server";
+                    ws.send(msgAck(true));
+                    try_load_and_send_file_chunk();
+                }
+                ul.onprogress(ul);
+            } else if (obj.MsgType == "MsgUploadConfUpdate") {
+                // server wants us to use a different chunk size and
+                // send-ahead from now on. Chunks in flight are fine.
+                upload_conf.ChunkSizeKB = obj.MsgData.ChunkSizeKB;
+                upload_conf.SendAhead = obj.MsgData.SendAhead;
+                try_load_and_send_file_chunk();
             } else if (obj.MsgType == "MsgError") {
                 ul.error_code = obj.MsgData.ErrorCode;
                 ul.error_msg = obj.MsgData.Msg;
@@ -246,6 +434,19 @@ _incoming_lib = function() {
             }
         };
 
+        // server_pause sets us up for waiting until the server resumes the
+        // upload. Everything that hasn't been acked will have to be sent
+        // again.
+        var server_pause = function server_pause(reason) {
+            ul.paused_by_server = true;
+            ul.pause_msg = reason;
+            ul.bytes_tx = ul.bytes_acked;
+            ul.chunks_ahead = 0;
+            ul.bytes_ahead = 0;
+            ul.can_cancel = true;
+            ul.state_msg = "paused by server: " + reason;
+        };
+
         // when all is uploaded, we wait for the incoming!! backend to tell us
         // that the upload is done; that even the web app backend is done
         // fetching the file from the incoming!! backend.
@@ -257,6 +458,38 @@ _incoming_lib = function() {
                 ul.state_msg = "all done";
                 ul.onprogress(ul);
                 ul.onfinished(ul);
+            } else if (obj.MsgType == "MsgRangeDone") {
+                // other connections are still uploading the rest of the file
+                ul.range_done = true;
+                ws.close();
+                ul.state_msg = "range uploaded";
+                ul.onprogress(ul);
+                ul.onrangedone(ul);
+            } else if (obj.MsgType == "MsgHandoverStatus") {
+                if (obj.MsgData.Progress >= 0) {
+                    ul.handover_frac_complete = obj.MsgData.Progress;
+                }
+                ul.handover_status = obj.MsgData.Status;
+                ul.scanning = obj.MsgData.Scanning;
+                if (ul.scanning) {
+                    ul.state_msg = "scanning file on server";
+                } else {
+                    ul.state_msg = "processing file on server";
+                    if (ul.handover_status) {
+                        ul.state_msg += ": " + ul.handover_status;
+                    }
+                }
+                ul.onprogress(ul);
+            } else if (obj.MsgType == "MsgCancel") {
+                // the server didn't take the file (for example because it is
+                // infected)
+                ul.scanning = false;
+                ul.cancelled = true;
+                ul.cancel_msg = obj.MsgData.Reason;
+                ul.state_msg = "cancelled: " + ul.cancel_msg;
+                ws.close();
+                ul.onprogress(ul);
+                ul.oncancelled(ul);
             } else if (obj.MsgType == "MsgError") {
                 ul.error_code = obj.MsgData.ErrorCode;
                 ul.error_msg = obj.MsgData.Msg;
@@ -278,6 +511,8 @@ _incoming_lib = function() {
             ul.bytes_ahead = 0;
             ul.connected = false;
             ul.paused = false;
+            ul.paused_by_server = false; // server tells us again if it is
+            ul.pause_msg = null;
             ul.can_cancel = true;
             ul.can_pause = false;
             ul.state_msg = "connecting to upload server";
@@ -300,7 +535,11 @@ _incoming_lib = function() {
                 ul.state_msg = "upload protocol handshake"
 
                 // send upload request
-                ws.send(msgUploadReq(upload_id, file.size, file.name));
+                ws.send(msgUploadReq(upload_id, file.size, file.name,
+                                     batch_index, batch_file_count,
+                                     ul.relative_path, range_start, range_end,
+                                     ul.sha256, compression_methods(),
+                                     file.type, file.lastModified));
 
                 // receive error or upload config
                 ws.onmessage = function prot01_recvConfig(msg) {
@@ -311,12 +550,43 @@ _incoming_lib = function() {
                         ul.onprogress(ul);
                         ul.onerror(ul);
                         ul.cancel("can't handle '" + ul.error_msg + "'");
+                    } else if (obj.MsgType == "MsgBusy") {
+                        // server can't take us right now. It closes the
+                        // connection, and we try again when it tells us to
+                        // (instead of the usual retry in ws.onclose)
+                        ws.onclose = function onclose_busy(msg) {
+                            ul.connected = false;
+                            ws = null;
+                            ul.onprogress(ul);
+                        };
+                        ul.state_msg = "server busy (" + obj.MsgData.Reason +
+                            "), trying again in " + obj.MsgData.RetryAfterS +
+                            " seconds";
+                        ul.can_pause = true;
+                        conn_retry = setTimeout(ul.start, obj.MsgData.RetryAfterS * 1000);
+                        ul.onprogress(ul);
+                    } else if (obj.MsgType == "MsgAllDone") {
+                        // upload was finished while we weren't connected
+                        ul.bytes_acked = ul.bytes_total;
+                        ul.bytes_tx = ul.bytes_total;
+                        ul.frac_complete = 1.0;
+                        ul.can_cancel = false;
+                        ul.can_pause = false;
+                        receive_final_message(msg);
+                    } else if (obj.MsgType == "MsgCancel") {
+                        // upload was cancelled while we weren't connected
+                        ul.cancelled = true;
+                        ul.can_cancel = false;
+                        ul.can_pause = false;
+                        ul.cancel_msg = obj.MsgData.Reason;
+                        ul.state_msg = "cancelled: " + ul.cancel_msg;
+                        ws.close();
+                        ul.onprogress(ul);
+                        ul.oncancelled(ul);
                     } else if (obj.MsgType == "MsgUploadConf") {
                         // got upload config. set us up for upload!
                         upload_conf = obj.MsgData;
-                        ul.bytes_acked = upload_conf.FilePos;
-                        ul.frac_complete = ul.bytes_acked / ul.bytes_total;
-                        ul.bytes_tx = ul.bytes_acked;
+                        set_missing(upload_conf.MissingRanges);
                         ws.send(msgAck(true));
                         // we might already be finished uploading data...
                         if (ul.bytes_acked == ul.bytes_total) {
@@ -324,6 +594,11 @@ _incoming_lib = function() {
                             ul.can_pause = false;
                             ul.state_msg = "processing file on server";
                             ws.onmessage = receive_final_message;
+                        } else if (upload_conf.PausedByServer) {
+                            // wait until the server resumes the upload
+                            ul.can_pause = true;
+                            server_pause(upload_conf.PauseReason);
+                            ws.onmessage = receive_chunk_acks;
                         } else {
                             ul.state_msg = "transfer file chunks to upload server"
                             ul.can_pause = true;
@@ -340,7 +615,8 @@ _incoming_lib = function() {
 
             ws.onclose = function onclose(msg) {
                 ul.connected = false;
-                if (ul.paused || ul.finished || ul.cancelled || ul.error_code != null) {
+                if (ul.paused || ul.finished || ul.range_done || ul.cancelled ||
+                        ul.error_code != null) {
                     ul.onprogress(ul);
                     ws = null;
                     return;
@@ -438,7 +714,7 @@ _incoming_lib = function() {
         // pause pauses, unpauses, or toggles pause, depending on the
         // parameter. "pause" pauses, "unpause" unpauses, "toggle" toggles.
         ul.pause = function pause(what) {
-            if (ul.finished || ul.cancelled) {
+            if (ul.finished || ul.range_done || ul.cancelled) {
                 return;
             }
 
@@ -480,6 +756,164 @@ _incoming_lib = function() {
         return ul;
     };
 
+    // ParallelUploader uploads a file over several connections at once: the
+    // file is split into as many ranges, and each range is uploaded by an
+    // uploader of its own. connections must not be larger than what the
+    // Incoming!! server allows (UploadMaxConnections). The returned object
+    // has the same properties, callbacks and functions as the object
+    // Uploader returns. For small files, or if connections is 1, it is such
+    // an object.
+    incoming_lib.ParallelUploader = function ParallelUploader(upload_id, file,
+            connections, batch_index, batch_file_count, relative_path) {
+        var n = Math.min(connections, file.size);
+        if (n < 2) {
+            return incoming_lib.Uploader(upload_id, file, batch_index,
+                                         batch_file_count, relative_path);
+        }
+
+        var pul = {};
+        var parts = [];
+        var over = false; // finished, cancelled or failed
+        pul.filename = file.name;
+        pul.bytes_total = file.size;
+        pul.onprogress = function(o){};
+        pul.onfinished = function(o){};
+        pul.oncancelled = function(o){};
+        pul.onerror = function(o){};
+
+        // update sums up what the parts know, with the state message of the
+        // part that has something to tell
+        var update = function update(part) {
+            pul.bytes_tx = 0;
+            pul.bytes_acked = 0;
+            pul.can_cancel = false;
+            pul.can_pause = false;
+            pul.connected = false;
+            pul.paused_by_server = false;
+            pul.scanning = false;
+            for (var i = 0; i < parts.length; i++) {
+                var p = parts[i];
+                pul.bytes_tx += p.bytes_tx;
+                pul.bytes_acked += p.bytes_acked;
+                pul.can_cancel = pul.can_cancel || p.can_cancel;
+                pul.can_pause = pul.can_pause || p.can_pause;
+                pul.connected = pul.connected || p.connected;
+                if (p.paused_by_server) {
+                    pul.paused_by_server = true;
+                    pul.pause_msg = p.pause_msg;
+                }
+                if (p.handover_frac_complete != null) {
+                    pul.handover_frac_complete = p.handover_frac_complete;
+                }
+                if (p.handover_status != null) {
+                    pul.handover_status = p.handover_status;
+                }
+                pul.scanning = pul.scanning || p.scanning;
+            }
+            pul.frac_complete = pul.bytes_acked / pul.bytes_total;
+            pul.paused = parts[0].paused;
+            if (!part.range_done) {
+                pul.state_msg = part.state_msg;
+            }
+            pul.onprogress(pul);
+        };
+
+        var range_size = Math.ceil(file.size / n);
+        for (var i = 0; i < n; i++) {
+            var end = Math.min((i + 1) * range_size, file.size);
+            var part = make_uploader(upload_id, file, {
+                batch_index: batch_index || 0,
+                batch_file_count: batch_file_count || 0,
+                relative_path: relative_path,
+                range_start: i * range_size,
+                range_end: end
+            });
+            part.onprogress = update;
+            part.onfinished = function onfinished(part) {
+                if (!over) {
+                    over = true;
+                    pul.finished = true;
+                    pul.state_msg = part.state_msg;
+                    update(part);
+                    pul.onfinished(pul);
+                }
+            };
+            part.oncancelled = function oncancelled(part) {
+                if (!over) {
+                    over = true;
+                    pul.cancelled = true;
+                    pul.cancel_msg = part.cancel_msg;
+                    pul.state_msg = part.state_msg;
+                    pul.cancel(part.cancel_msg);
+                    update(part);
+                    pul.oncancelled(pul);
+                }
+            };
+            part.onerror = function onerror(part) {
+                if (!over) {
+                    over = true;
+                    pul.error_code = part.error_code;
+                    pul.error_msg = part.error_msg;
+                    pul.state_msg = part.state_msg;
+                    pul.cancel("error on another connection: " + part.error_msg);
+                    update(part);
+                    pul.onerror(pul);
+                }
+            };
+            parts.push(part);
+        }
+        pul.relative_path = parts[0].relative_path;
+        pul.sha256 = null;
+        pul.compress = false;
+        pul.bytes_tx = 0;
+        pul.bytes_acked = 0;
+        pul.frac_complete = 0.0;
+        pul.handover_frac_complete = null;
+        pul.handover_status = null;
+        pul.scanning = false;
+        pul.finished = false;
+        pul.cancelled = false;
+        pul.can_cancel = true;
+        pul.can_pause = false;
+        pul.connected = false;
+        pul.paused = false;
+        pul.paused_by_server = false;
+        pul.error_code = null;
+        pul.error_msg = null;
+        pul.cancel_msg = null;
+        pul.pause_msg = null;
+        pul.state_msg = "not yet started";
+
+        pul.start = function start() {
+            for (var i = 0; i < parts.length; i++) {
+                parts[i].sha256 = pul.sha256;
+                parts[i].compress = pul.compress;
+                parts[i].start();
+            }
+            return pul;
+        };
+
+        pul.cancel = function cancel(reason) {
+            for (var i = 0; i < parts.length; i++) {
+                if (!parts[i].range_done) {
+                    parts[i].cancel(reason);
+                }
+            }
+            return pul;
+        };
+
+        pul.pause = function pause(what) {
+            if (what == "toggle") {
+                what = pul.paused ? "unpause" : "pause";
+            }
+            for (var i = 0; i < parts.length; i++) {
+                parts[i].pause(what);
+            }
+        };
+
+        return pul;
+    };
+
     return incoming_lib;
 }
 
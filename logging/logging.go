@@ -0,0 +1,235 @@
+/*
+Leveled, structured logging. Each log line has a time stamp, a level, a
+message, and any number of key/value fields, and is written either in logfmt
+(key=value pairs) or as a JSON object. Loggers carry fields that are added to
+every line they write, so that for example all lines about an upload carry its
+id.
+
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error" into a Level.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.ToLower(s) == l.String() {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", s)
+}
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// output settings, shared by all loggers
+var (
+	outLock   sync.Mutex
+	out       io.Writer = os.Stderr
+	outLevel            = LevelInfo
+	outFormat           = FormatLogfmt
+)
+
+// Configure sets the minimum level of lines that are written, and the output
+// format (FormatLogfmt or FormatJSON).
+func Configure(level Level, format string) error {
+	if format != FormatLogfmt && format != FormatJSON {
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	outLock.Lock()
+	outLevel = level
+	outFormat = format
+	outLock.Unlock()
+	return nil
+}
+
+// SetOutput sets where log lines are written to. The default is stderr.
+func SetOutput(w io.Writer) {
+	outLock.Lock()
+	out = w
+	outLock.Unlock()
+}
+
+// Lazy is a field value that is evaluated only when a line is written. Use it
+// for values that change during a logger's life time, such as an upload's
+// state.
+type Lazy func() interface{}
+
+// Logger writes log lines with a fixed set of fields. Loggers are immutable
+// and safe for concurrent use.
+type Logger struct {
+	fields []interface{} // key, value, key, value, ...
+}
+
+// root logger, without any fields
+var root = new(Logger)
+
+// With returns a logger that adds the given key/value pairs to each line.
+func With(keysAndValues ...interface{}) *Logger {
+	return root.With(keysAndValues...)
+}
+
+// With returns a logger that adds the given key/value pairs to each line, in
+// addition to the fields of l.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	n := new(Logger)
+	n.fields = make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	n.fields = append(n.fields, l.fields...)
+	n.fields = append(n.fields, keysAndValues...)
+	return n
+}
+
+func Debug(msg string, keysAndValues ...interface{}) {
+	root.write(LevelDebug, msg, keysAndValues)
+}
+func Info(msg string, keysAndValues ...interface{}) {
+	root.write(LevelInfo, msg, keysAndValues)
+}
+func Warn(msg string, keysAndValues ...interface{}) {
+	root.write(LevelWarn, msg, keysAndValues)
+}
+func Error(msg string, keysAndValues ...interface{}) {
+	root.write(LevelError, msg, keysAndValues)
+}
+
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.write(LevelDebug, msg, keysAndValues)
+}
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.write(LevelInfo, msg, keysAndValues)
+}
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.write(LevelWarn, msg, keysAndValues)
+}
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.write(LevelError, msg, keysAndValues)
+}
+
+// write formats and writes one log line
+func (l *Logger) write(level Level, msg string, keysAndValues []interface{}) {
+	outLock.Lock()
+	minLevel, format := outLevel, outFormat
+	outLock.Unlock()
+	if level < minLevel {
+		return
+	}
+
+	// collect all fields. Fixed ones first, then ours, then the ones given
+	// for this line.
+	kv := make([]interface{}, 0, 6+len(l.fields)+len(keysAndValues))
+	kv = append(kv, "time", time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		"level", level.String(), "msg", msg)
+	kv = append(kv, l.fields...)
+	kv = append(kv, keysAndValues...)
+	if len(kv)%2 != 0 {
+		kv = append(kv, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	if format == FormatJSON {
+		writeJSON(&buf, kv)
+	} else {
+		writeLogfmt(&buf, kv)
+	}
+	buf.WriteByte('\n')
+
+	outLock.Lock()
+	out.Write(buf.Bytes())
+	outLock.Unlock()
+}
+
+// fieldValue evaluates lazy values and turns errors into strings
+func fieldValue(v interface{}) interface{} {
+	if lazy, ok := v.(Lazy); ok {
+		v = lazy()
+	}
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	return v
+}
+
+func writeLogfmt(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(kv[i]))
+		buf.WriteByte('=')
+		s := fmt.Sprint(fieldValue(kv[i+1]))
+		if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, kv []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(kv[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		val, err := json.Marshal(fieldValue(kv[i+1]))
+		if err != nil {
+			val, _ = json.Marshal(fmt.Sprint(kv[i+1]))
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+}
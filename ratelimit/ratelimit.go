@@ -0,0 +1,152 @@
+/*
+A rate limiter limits how many bytes per second may pass through it, and
+measures how many bytes per second actually do. Limits are enforced with a
+token bucket: callers reserve bytes, and are told how long they have to wait
+before they may proceed.
+
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// time constant for the measured rate. Bytes that passed longer ago than
+// that have little influence on Rate().
+const meterTau = 5 * time.Second
+
+// Limiter is a token bucket with a rate meter. It is safe for concurrent use.
+type Limiter struct {
+	lock sync.Mutex
+
+	// limit in bytes per second (0: unlimited), and how many bytes may pass
+	// in one burst
+	limit float64
+	burst float64
+
+	// tokens in the bucket. Can be negative if callers have reserved more
+	// than there was; they then wait until the debt is paid.
+	tokens     float64
+	lastRefill time.Time
+
+	// exponentially decaying byte count, for measuring the rate
+	meterVal  float64
+	meterLast time.Time
+}
+
+// NewLimiter makes a Limiter with a limit in bytes per second. A limit of 0
+// means unlimited; the Limiter then only measures.
+func NewLimiter(bytesPerS uint64) *Limiter {
+	l := new(Limiter)
+	now := time.Now()
+	l.lastRefill = now
+	l.meterLast = now
+	l.setLimit(bytesPerS)
+	l.tokens = l.burst
+	return l
+}
+
+// SetLimit changes the limit (bytes per second, 0: unlimited).
+func (l *Limiter) SetLimit(bytesPerS uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(time.Now())
+	l.setLimit(bytesPerS)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// setLimit sets limit and burst. l.lock must be held!
+func (l *Limiter) setLimit(bytesPerS uint64) {
+	l.limit = float64(bytesPerS)
+	l.burst = l.limit // one second's worth
+}
+
+// Limit returns the limit in bytes per second (0: unlimited).
+func (l *Limiter) Limit() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return uint64(l.limit)
+}
+
+// refill puts tokens into the bucket for the time that has passed since the
+// last refill. l.lock must be held!
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += l.limit * now.Sub(l.lastRefill).Seconds()
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.lastRefill = now
+}
+
+// Reserve takes n bytes out of the bucket, and returns how long the caller
+// has to wait before the bytes may pass. The bytes are counted by the rate
+// meter right away.
+func (l *Limiter) Reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+
+	l.decayMeter(now)
+	l.meterVal += float64(n)
+
+	if l.limit == 0 {
+		return 0
+	}
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.limit * float64(time.Second))
+}
+
+// decayMeter lets the meter's byte count decay to the given point in time.
+// l.lock must be held!
+func (l *Limiter) decayMeter(now time.Time) {
+	dt := now.Sub(l.meterLast).Seconds()
+	l.meterVal *= math.Exp(-dt / meterTau.Seconds())
+	l.meterLast = now
+}
+
+// Rate returns the measured rate in bytes per second, averaged over the last
+// few seconds.
+func (l *Limiter) Rate() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.decayMeter(time.Now())
+	return l.meterVal / meterTau.Seconds()
+}
+
+// ReserveAll reserves n bytes from each of the given limiters (nil ones are
+// skipped), and returns the longest of the waits.
+func ReserveAll(n int, limiters ...*Limiter) (wait time.Duration) {
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if d := l.Reserve(n); d > wait {
+			wait = d
+		}
+	}
+	return
+}
@@ -31,6 +31,8 @@ import (
 // Help text for ChannelledUUIDPool
 type ChannelledUUIDPool struct {
 	new_uuids    chan string
+	add_uuids    chan string
+	add_errors   chan error
 	remove_uuids chan string
 	quit         chan bool
 	uids         map[string]bool
@@ -39,6 +41,8 @@ type ChannelledUUIDPool struct {
 func NewChannelledUUIDPool() *ChannelledUUIDPool {
 	p := new(ChannelledUUIDPool)
 	p.new_uuids = make(chan string)
+	p.add_uuids = make(chan string)
+	p.add_errors = make(chan error)
 	p.remove_uuids = make(chan string)
 	p.quit = make(chan bool)
 	p.uids = make(map[string]bool)
@@ -55,6 +59,8 @@ func (p *ChannelledUUIDPool) mainLoop() error {
 		select {
 		case p.new_uuids <- next_uuid:
 			next_uuid = p.makeNewUUID()
+		case uuid := <-p.add_uuids:
+			p.add_errors <- p.add(uuid)
 		case uuid := <-p.remove_uuids:
 			_ = p.remove(uuid)
 			// TODO: can't propagate the error to whoever sent uuid
@@ -82,6 +88,22 @@ func (p *ChannelledUUIDPool) New() string {
 	return <-p.new_uuids
 }
 
+// Help text for add
+func (p *ChannelledUUIDPool) add(id string) error {
+	if _, exists := p.uids[id]; exists {
+		return fmt.Errorf("Tried to add existing uid %s", id)
+	}
+
+	p.uids[id] = true
+	return nil
+}
+
+// Help text for Add
+func (p *ChannelledUUIDPool) Add(id string) error {
+	p.add_uuids <- id
+	return <-p.add_errors
+}
+
 // Help text for remove
 func (p *ChannelledUUIDPool) remove(id string) error {
 	if _, exists := p.uids[id]; !exists {
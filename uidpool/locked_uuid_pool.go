@@ -51,6 +51,18 @@ func (p *LockedUUIDPool) New() string {
 	}
 }
 
+// Help text for Add
+func (p *LockedUUIDPool) Add(id string) error {
+	p.Lock()
+	defer p.Unlock()
+	if _, exists := p.uids[id]; exists {
+		return fmt.Errorf("Tried to add existing uid %s", id)
+	}
+
+	p.uids[id] = true
+	return nil
+}
+
 // Help text for Remove
 func (p *LockedUUIDPool) Remove(id string) error {
 	p.Lock()
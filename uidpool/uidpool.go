@@ -29,6 +29,10 @@ type UIDPool interface {
 	// Help text for New
 	New() string
 
+	// Add puts a given uid into the pool, for example one that was handed
+	// out before a restart. It fails if the uid is in the pool already.
+	Add(string) error
+
 	// Help text for Remove
 	Remove(string) error
 
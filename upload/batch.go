@@ -0,0 +1,570 @@
+/*
+Incoming!! batches: several uploads under one ticket
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uit-no/incoming/logging"
+	"github.com/uit-no/incoming/uidpool"
+)
+
+// Batch is a ticket for several files. The browser tells how many files
+// there are when it starts uploading the first one, and each file then gets
+// its own uploader (with its own id, the file's "sub-id"), which works just
+// like an uploader made for a single file ticket. When all files are done
+// (finished or cancelled), the batch hands them over to the app backend in
+// one request.
+//
+// If the batch has a file signal finish URL, each file is also handed over
+// on its own as soon as it is complete, to that URL. Otherwise, files are not
+// handed over on their own, and their uploads finish as soon as they are
+// complete.
+//
+// Files of a batch are stored in a directory of their own, named after the
+// batch id, within the storage directory. Files can have a relative path
+// (for example when the browser uploads a whole folder), and are then stored
+// at that path within the batch's directory, so that the folder's tree is
+// recreated there.
+//
+// Files of a batch never remove their file when they are cleaned up. The
+// batch does that, after the batch handover, if it was asked to, by removing
+// its whole directory.
+type Batch struct {
+	lock sync.Mutex
+
+	pool        *BatchPool
+	uploaders   UploaderPool
+	deadLetters *DeadLetterList
+	id          string
+	tenant      string
+	config      Config
+	log         *logging.Logger
+	dir         string
+
+	signalFinishURL        *url.URL
+	fileSignalFinishURL    *url.URL // nil: no per-file handover
+	backendSecret          string
+	metadata               map[string]string // from the app backend
+	removeFileWhenFinished bool
+	maxFiles               int
+	maxTotalBytes          int64 // 0: no limit
+
+	state        int
+	cancelReason string
+
+	// files as declared by the browser, and the uploaders for those of them
+	// that have been started (by index)
+	fileCount  int
+	totalBytes int64
+	files      []*UploadToLocalFile
+	filesDone  int
+
+	// relative paths of the files that have one
+	relativePaths []string
+
+	chHandoverDone chan struct{}
+
+	// fires when the batch has been idle for too long, i.e. when there was
+	// no file in progress for the config's IdleTimeout
+	idleTimer *time.Timer
+}
+
+// NewBatch makes a batch for up to maxFiles files with up to maxTotalBytes
+// bytes altogether (0: no limit). The files' uploaders are put into
+// uploaders, with the given config. fileSignalFinishURL may be nil, in which
+// case files are not handed over on their own. metadata is passed on to the
+// app backend with the batch handover, and with the handovers of its files.
+func NewBatch(pool *BatchPool, uploaders UploaderPool,
+	deadLetters *DeadLetterList, storageDir string,
+	signalFinishURL *url.URL, fileSignalFinishURL *url.URL,
+	removeFileWhenFinished bool, backendSecret string, tenant string,
+	metadata map[string]string, maxFiles int, maxTotalBytes int64,
+	conf Config) *Batch {
+
+	b := new(Batch)
+	b.pool = pool
+	b.uploaders = uploaders
+	b.deadLetters = deadLetters
+	b.tenant = tenant
+	b.config = conf
+	b.signalFinishURL = signalFinishURL
+	b.fileSignalFinishURL = fileSignalFinishURL
+	b.backendSecret = backendSecret
+	b.metadata = metadata
+	b.removeFileWhenFinished = removeFileWhenFinished
+	b.maxFiles = maxFiles
+	b.maxTotalBytes = maxTotalBytes
+	b.state = StateInit
+	b.chHandoverDone = make(chan struct{})
+
+	b.id = pool.put(b)
+	b.log = logging.With("batch", b.id, "tenant", b.tenant)
+	b.dir = path.Join(storageDir, b.id)
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		// files will fail when they are created
+		b.log.Error("could not create directory for batch", "path", b.dir,
+			"err", err)
+	}
+	b.lock.Lock()
+	b.idleTimer = time.AfterFunc(conf.IdleTimeout, b.timedOut)
+	b.lock.Unlock()
+	b.log.Info("new batch", "signalFinishURL", signalFinishURL.String(),
+		"maxFiles", maxFiles, "maxTotalBytes", maxTotalBytes)
+	return b
+}
+
+func (b *Batch) GetId() string {
+	return b.id
+}
+
+func (b *Batch) GetTenant() string {
+	return b.tenant
+}
+
+func (b *Batch) GetBackendSecret() string {
+	return b.backendSecret
+}
+
+func (b *Batch) GetConfig() Config {
+	return b.config
+}
+
+func (b *Batch) GetState() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// File returns the uploader for file number index of the batch, and whether
+// it was made just now. The browser tells how many files the batch has
+// (count) with every file, the size of the file, and optionally its path
+// relative to the folder that is uploaded (see CleanRelativePath). The first
+// file fixes the count, and each new file must fit into the batch's size
+// limit, and must not have the same path as another file. Uploaders of files
+// that have been started already are returned even when the batch is over,
+// so that a reconnecting browser learns the outcome.
+func (b *Batch) File(index int, count int, size int64,
+	relativePath string) (u Uploader, created bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.fileCount != 0 && index >= 0 && index < b.fileCount &&
+		b.files[index] != nil {
+		return b.files[index], false, nil
+	}
+	if b.state >= StateHandingOver {
+		return nil, false, errors.New("batch is closed")
+	}
+
+	if b.fileCount == 0 {
+		if count < 1 || count > b.maxFiles {
+			return nil, false, fmt.Errorf("batch can have between 1 and %d files",
+				b.maxFiles)
+		}
+		b.fileCount = count
+		b.files = make([]*UploadToLocalFile, count)
+		b.log.Info("browser declared files", "fileCount", count)
+	} else if count != b.fileCount {
+		return nil, false, fmt.Errorf("batch has %d files, not %d", b.fileCount,
+			count)
+	}
+	if index < 0 || index >= b.fileCount {
+		return nil, false, fmt.Errorf("file index must be between 0 and %d",
+			b.fileCount-1)
+	}
+	if size < 0 || (b.maxTotalBytes > 0 && b.totalBytes+size > b.maxTotalBytes) {
+		return nil, false, errors.New("file would make batch larger than allowed")
+	}
+	if relativePath != "" {
+		relativePath, err = CleanRelativePath(relativePath)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, other := range b.relativePaths {
+			if other == relativePath ||
+				strings.HasPrefix(other, relativePath+"/") ||
+				strings.HasPrefix(relativePath, other+"/") {
+				return nil, false, fmt.Errorf("relative path %q clashes with "+
+					"that of another file", relativePath)
+			}
+		}
+	}
+
+	fileURL := b.signalFinishURL
+	if b.fileSignalFinishURL != nil {
+		fileURL = b.fileSignalFinishURL
+	}
+	f := newUploadToLocalFile(b.uploaders, b.deadLetters, b.dir,
+		fileURL, false, b.backendSecret, b.tenant, b.metadata, b.config, b,
+		index, "")
+	f.relativePath = relativePath
+	b.files[index] = f
+	if relativePath != "" {
+		b.relativePaths = append(b.relativePaths, relativePath)
+	}
+	b.totalBytes += size
+	b.state = StateUploading
+	b.idleTimer.Stop() // files have timeouts of their own
+	return f, true, nil
+}
+
+// fileDone is called by a file's uploader when the file is finished or
+// cancelled. It must not be called with the uploader's lock held.
+func (b *Batch) fileDone(index int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.filesDone++
+	if b.state >= StateHandingOver {
+		return
+	}
+	if b.filesDone == b.fileCount {
+		b.state = StateHandingOver
+		b.idleTimer.Stop()
+		go b.handOver()
+		return
+	}
+	if b.filesDone == b.filesStarted() {
+		b.idleTimer.Reset(b.config.IdleTimeout)
+	}
+}
+
+// filesStarted returns how many files have an uploader. b.lock must be held!
+func (b *Batch) filesStarted() (n int) {
+	for _, f := range b.files {
+		if f != nil {
+			n++
+		}
+	}
+	return
+}
+
+// pendingFiles returns how many files the batch may still start
+func (b *Batch) pendingFiles() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case b.state >= StateHandingOver:
+		return 0
+	case b.fileCount == 0:
+		return b.maxFiles
+	}
+	return b.fileCount - b.filesStarted()
+}
+
+// timedOut cancels the batch when it has been idle for too long, and tells
+// the app backend.
+func (b *Batch) timedOut() {
+	b.lock.Lock()
+	if b.state >= StateHandingOver || b.filesDone != b.filesStarted() {
+		// some file got going just now
+		b.lock.Unlock()
+		return
+	}
+	b.state = StateCancelled
+	b.cancelReason = "batch timed out"
+	b.lock.Unlock()
+
+	b.log.Info("batch timed out")
+	b.handOver()
+}
+
+// Cancel ends the batch, and cancels all its files that are still in
+// progress. The app backend is not told, so this is for the app backend to
+// call. An error is returned if the batch is being handed over or over
+// already.
+func (b *Batch) Cancel(reason string) error {
+	b.lock.Lock()
+	if b.state >= StateHandingOver {
+		b.lock.Unlock()
+		return errors.New("too late to cancel")
+	}
+	b.state = StateCancelled
+	b.cancelReason = reason
+	b.idleTimer.Stop()
+	files := append([]*UploadToLocalFile(nil), b.files...)
+	b.lock.Unlock()
+
+	b.log.Info("batch cancelled", "reason", reason)
+	for _, f := range files {
+		if f != nil {
+			_ = f.Cancel(false, reason, 0) // fails for files that are done
+		}
+	}
+	b.cleanUp(files, b.removeFileWhenFinished)
+	return nil
+}
+
+// HandoverDone should be called by the app backend when it is finished
+// obtaining the batch's files (if it answered "wait" to the batch handover).
+func (b *Batch) HandoverDone() error {
+	if b.GetState() != StateHandingOver {
+		return errors.New("batch is not in 'handing over' state")
+	}
+
+	select {
+	case b.chHandoverDone <- struct{}{}:
+		return nil
+	case <-time.After(1 * time.Second):
+		return errors.New("no waiting handover routine")
+	}
+}
+
+// handOver tells the app backend about all files of the batch. If the batch
+// was cancelled, this is just a notification. Otherwise, the request is
+// retried, and we wait for the backend if it wants us to, just like with the
+// handover of a single file. Afterwards, the batch and its files are cleaned
+// up.
+func (b *Batch) handOver() {
+	b.lock.Lock()
+	cancelled := (b.state == StateCancelled)
+	cancelReason := b.cancelReason
+	fileCount := b.fileCount
+	files := append([]*UploadToLocalFile(nil), b.files...)
+	b.lock.Unlock()
+
+	v := url.Values{}
+	v.Set("id", b.id)
+	v.Set("backendSecret", b.backendSecret)
+	if cancelled {
+		v.Set("cancelled", "yes")
+	} else {
+		v.Set("cancelled", "no")
+	}
+	v.Set("cancelReason", cancelReason)
+	addMetadata(v, "", b.metadata)
+	v.Set("fileCount", strconv.Itoa(fileCount))
+	for i, f := range files {
+		prefix := fmt.Sprintf("file.%d.", i)
+		if f == nil {
+			v.Set(prefix+"cancelled", "yes")
+			v.Set(prefix+"cancelReason", "file was never uploaded")
+			continue
+		}
+		info := f.batchFileInfo()
+		v.Set(prefix+"id", info.id)
+		v.Set(prefix+"filenameFromBrowser", info.nameFromBrowser)
+		v.Set(prefix+"relativePath", info.relativePath)
+		v.Set(prefix+"size", strconv.FormatInt(info.size, 10))
+		if info.finished {
+			v.Set(prefix+"filename", info.path)
+			v.Set(prefix+"cancelled", "no")
+			if info.encryptionKey != "" {
+				v.Set(prefix+"encryption", EncryptionFormat)
+				v.Set(prefix+"encryptionKey", info.encryptionKey)
+			}
+		} else {
+			v.Set(prefix+"filename", "")
+			v.Set(prefix+"cancelled", "yes")
+			v.Set(prefix+"cancelReason", info.cancelReason)
+		}
+		for key, values := range info.extra {
+			v[prefix+key] = values
+		}
+	}
+
+	htclient := new(http.Client)
+	htclient.Timeout = b.config.HandoverTimeout
+	if cancelled {
+		resp, _, err := postHandover(htclient, b.signalFinishURL.String(), v, 0,
+			b.log)
+		if err == nil {
+			resp.Body.Close()
+		} else {
+			b.log.Warn("couldn't tell app backend that batch was cancelled",
+				"err", err)
+		}
+		b.cleanUp(files, b.removeFileWhenFinished)
+		return
+	}
+
+	b.log.Info("all files are done, handing batch over to app")
+	resp, attempts, err := postHandover(htclient, b.signalFinishURL.String(), v,
+		b.config.HandoverRetryWindow, b.log) // this takes time
+	var reply *handoverReply
+	if err == nil {
+		reply, err = readHandoverReply(resp)
+	}
+	if err == nil && reply.Filename != "" {
+		b.log.Warn("ignoring filename in reply to batch handover",
+			"filename", reply.Filename)
+	}
+	if err == nil && reply.Action == handoverActionWait {
+		timeout := reply.confirmTimeout(b.config.HandoverConfirmTimeout)
+		b.log.Info("wait for app backend", "timeout", timeout.String())
+		select {
+		case <-b.chHandoverDone:
+		case <-time.After(timeout):
+			err = errors.New("Timed out waiting for app backend to retrieve the files")
+		}
+	}
+
+	b.lock.Lock()
+	if err == nil {
+		b.state = StateFinished
+	} else {
+		b.state = StateCancelled
+		b.cancelReason = fmt.Sprintf("handover failed: %s", err)
+	}
+	b.lock.Unlock()
+
+	// as with single files, a failed handover keeps the files, and leaves a
+	// dead letter
+	if err != nil {
+		b.log.Warn("batch handover failed", "err", err, "attempts", attempts)
+		if b.deadLetters != nil {
+			b.deadLetters.Add(&DeadLetter{
+				Id:                     b.id,
+				Tenant:                 b.tenant,
+				SignalFinishURL:        b.signalFinishURL.String(),
+				BatchId:                b.id,
+				Error:                  err.Error(),
+				Attempts:               attempts,
+				FailedAt:               time.Now(),
+				form:                   v,
+				removeFileWhenFinished: b.removeFileWhenFinished,
+				batchDir:               b.dir,
+			})
+		}
+		b.cleanUp(files, false)
+		return
+	}
+	b.log.Info("batch handed over")
+	b.cleanUp(files, b.removeFileWhenFinished)
+}
+
+// cleanUp removes the batch from its pool, and cleans up its files. If
+// removeFiles is true, it removes the batch's directory with all files in it.
+func (b *Batch) cleanUp(files []*UploadToLocalFile, removeFiles bool) {
+	for _, f := range files {
+		if f != nil {
+			_ = f.CleanUp() // fails for files whose handover is still running
+		}
+	}
+	if removeFiles {
+		if err := os.RemoveAll(b.dir); err != nil {
+			b.log.Warn("could not remove directory of batch", "path", b.dir,
+				"err", err)
+		}
+	}
+	b.pool.remove(b.id)
+	b.log.Debug("batch cleaned up")
+}
+
+// CleanRelativePath makes a relative path from the browser (such as a
+// file's webkitRelativePath) safe to use within a batch's directory.
+// Backslashes count as separators, and "." and empty elements are dropped.
+// Absolute paths, paths with "..", and paths that end up empty are refused.
+func CleanRelativePath(p string) (string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", errors.New("relative path must not contain NUL")
+	}
+	p = strings.Replace(p, "\\", "/", -1)
+	if strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("relative path %q is absolute", abbreviate(p, 40))
+	}
+	var elems []string
+	for i, elem := range strings.Split(p, "/") {
+		switch {
+		case elem == "" || elem == ".":
+			continue
+		case elem == "..":
+			return "", fmt.Errorf("relative path %q must not contain '..'",
+				abbreviate(p, 40))
+		case i == 0 && strings.HasSuffix(elem, ":"):
+			// Windows drive letter
+			return "", fmt.Errorf("relative path %q is absolute", abbreviate(p, 40))
+		}
+		elems = append(elems, elem)
+	}
+	if len(elems) == 0 {
+		return "", errors.New("relative path is empty")
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// BatchPool holds all batches, by id.
+type BatchPool struct {
+	uidPool uidpool.UIDPool
+	lock    sync.Mutex
+	batches map[string]*Batch
+}
+
+func NewBatchPool() *BatchPool {
+	p := new(BatchPool)
+	p.uidPool = uidpool.NewUIDPool()
+	p.batches = make(map[string]*Batch)
+	return p
+}
+
+func (p *BatchPool) Get(id string) (b *Batch, exists bool) {
+	p.lock.Lock()
+	b, exists = p.batches[id]
+	p.lock.Unlock()
+	return
+}
+
+func (p *BatchPool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.batches)
+}
+
+// PendingFiles returns how many files the batches may still start: all
+// the files a batch may have until the browser declares them, and the
+// declared files that haven't been started after that.
+func (p *BatchPool) PendingFiles() (n int) {
+	p.lock.Lock()
+	batches := make([]*Batch, 0, len(p.batches))
+	for _, b := range p.batches {
+		batches = append(batches, b)
+	}
+	p.lock.Unlock()
+
+	for _, b := range batches {
+		n += b.pendingFiles()
+	}
+	return
+}
+
+func (p *BatchPool) put(b *Batch) (id string) {
+	id = p.uidPool.New()
+	p.lock.Lock()
+	p.batches[id] = b
+	p.lock.Unlock()
+	return
+}
+
+func (p *BatchPool) remove(id string) {
+	p.lock.Lock()
+	delete(p.batches, id)
+	p.lock.Unlock()
+	p.uidPool.Remove(id)
+}
@@ -0,0 +1,71 @@
+/*
+Incoming!! tests for batches of uploads
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"testing"
+)
+
+func TestCleanRelativePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string // "": refused
+	}{
+		{"a.txt", "a.txt"},
+		{"dir/a.txt", "dir/a.txt"},
+		{"dir/sub/a.txt", "dir/sub/a.txt"},
+		{"dir\\sub\\a.txt", "dir/sub/a.txt"},
+		{"dir\\sub/a.txt", "dir/sub/a.txt"},
+		{"dir//a.txt", "dir/a.txt"},
+		{"dir/./a.txt", "dir/a.txt"},
+		{"./a.txt", "a.txt"},
+		{"dir/", "dir"},
+		{"a..b.txt", "a..b.txt"},
+		{"...", "..."},
+		{"../x", ""},
+		{"a/../../x", ""},
+		{"a/..", ""},
+		{"..\\x", ""},
+		{"..", ""},
+		{"/etc/passwd", ""},
+		{"\\x", ""},
+		{"//server/share/x", ""},
+		{"C:\\x", ""},
+		{"C:/x", ""},
+		{"", ""},
+		{".", ""},
+		{"./", ""},
+		{"//", ""},
+		{"a\x00b", ""},
+		{"dir/a.txt\x00", ""},
+	}
+	for _, test := range tests {
+		got, err := CleanRelativePath(test.path)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: got %q, want refusal", test.path, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%q: got %q (%v), want %q", test.path, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Incoming!! dead letters: handovers that failed for good
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/uit-no/incoming/logging"
+)
+
+// DeadLetter is a handover that failed for good, even after retries. The
+// uploaded file is kept, so that the handover can be replayed later (for
+// example when the app backend is up again).
+type DeadLetter struct {
+	Id                  string
+	Tenant              string
+	SignalFinishURL     string
+	FileName            string // where the file is on disk
+	FileNameFromBrowser string
+	BatchId             string // for the handover of a whole batch
+	Error               string // why the last attempt failed
+	Attempts            int
+	FailedAt            time.Time
+
+	// the 'file is here' request we couldn't deliver
+	form                   url.Values
+	removeFileWhenFinished bool
+	batchDir               string // where the files of a batch are on disk
+}
+
+// DeadLetterList holds dead letters until they are replayed successfully.
+// Dead letters are kept in memory only, and since the storage directory is
+// emptied on startup (but for partial uploads), they don't survive a restart.
+type DeadLetterList struct {
+	lock    sync.Mutex
+	letters map[string]*DeadLetter
+}
+
+func NewDeadLetterList() *DeadLetterList {
+	l := new(DeadLetterList)
+	l.letters = make(map[string]*DeadLetter)
+	return l
+}
+
+// Add puts a dead letter into the list, replacing any older one with the same
+// upload id.
+func (l *DeadLetterList) Add(d *DeadLetter) {
+	l.lock.Lock()
+	l.letters[d.Id] = d
+	l.lock.Unlock()
+}
+
+// GetAll returns copies of all dead letters in the list.
+func (l *DeadLetterList) GetAll() (res []DeadLetter) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	res = make([]DeadLetter, 0, len(l.letters))
+	for _, d := range l.letters {
+		res = append(res, *d)
+	}
+	return
+}
+
+func (l *DeadLetterList) Size() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.letters)
+}
+
+// Replay sends the 'file is here' request of a dead letter to the app backend
+// again. If the backend answers with status 200, the dead letter is removed
+// from the list. If the backend answers "done" and the upload was to remove
+// its file when finished, the file is removed as well (for a batch, the
+// batch's directory with all its files). If it answers "wait", the file is
+// left alone, because there is no upload any more that could wait for the
+// backend to confirm.
+func (l *DeadLetterList) Replay(id string, reqTimeout time.Duration) error {
+	l.lock.Lock()
+	d, ok := l.letters[id]
+	l.lock.Unlock()
+	if !ok {
+		return errors.New("no dead letter with that id")
+	}
+
+	htclient := new(http.Client)
+	htclient.Timeout = reqTimeout
+	resp, err := htclient.PostForm(d.SignalFinishURL, d.form)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return errors.New("Got bad http status on handover: " + resp.Status)
+	}
+	reply, err := readHandoverReply(resp)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	delete(l.letters, id)
+	l.lock.Unlock()
+
+	if d.BatchId != "" {
+		d.replayedBatch(reply)
+		return nil
+	}
+
+	log := logging.With("upload", id, "tenant", d.Tenant)
+	log.Info("replayed handover")
+	if reply.Filename != "" {
+		newPath := path.Join(path.Dir(d.FileName), reply.Filename)
+		if err := os.Rename(d.FileName, newPath); err != nil {
+			log.Warn("could not rename file after replayed handover",
+				"path", d.FileName, "err", err)
+		} else {
+			d.FileName = newPath
+		}
+	}
+	if reply.Action == handoverActionDone && d.removeFileWhenFinished {
+		if err := os.Remove(d.FileName); err != nil {
+			log.Warn("could not remove file after replayed handover",
+				"path", d.FileName, "err", err)
+		}
+	}
+	return nil
+}
+
+// Delete removes a dead letter from the list, and removes its file (for a
+// batch, the batch's directory with all its files), for handovers that an
+// admin gives up on.
+func (l *DeadLetterList) Delete(id string) error {
+	l.lock.Lock()
+	d, ok := l.letters[id]
+	l.lock.Unlock()
+	if !ok {
+		return errors.New("no dead letter with that id")
+	}
+
+	var err error
+	if d.BatchId != "" {
+		err = os.RemoveAll(d.batchDir)
+	} else {
+		err = os.Remove(d.FileName)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l.lock.Lock()
+	delete(l.letters, id)
+	l.lock.Unlock()
+	logging.Info("deleted dead letter", "upload", id, "tenant", d.Tenant)
+	return nil
+}
+
+// replayedBatch cleans up after the replayed handover of a batch, which got
+// the given reply.
+func (d *DeadLetter) replayedBatch(reply *handoverReply) {
+	log := logging.With("batch", d.BatchId, "tenant", d.Tenant)
+	log.Info("replayed batch handover")
+	if reply.Filename != "" {
+		log.Warn("ignoring filename in reply to batch handover",
+			"filename", reply.Filename)
+	}
+	if reply.Action == handoverActionDone && d.removeFileWhenFinished {
+		if err := os.RemoveAll(d.batchDir); err != nil {
+			log.Warn("could not remove directory of batch after replayed "+
+				"handover", "path", d.batchDir, "err", err)
+		}
+	}
+}
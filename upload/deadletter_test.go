@@ -0,0 +1,126 @@
+/*
+Incoming!! tests for handovers that failed for good
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterAfterRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the app backend has the file renamed and waits, but never confirms.
+	// When the handover is replayed, it is done.
+	filenames := make(chan string, 2)
+	replies := []string{`{"action":"wait","filename":"renamed.txt"}`, "done"}
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			filenames <- r.FormValue("filename")
+			fmt.Fprint(w, replies[0])
+			replies = replies[1:]
+		}))
+	defer backend.Close()
+	finishURL, _ := url.Parse(backend.URL)
+
+	deadLetters := NewDeadLetterList()
+	u := NewUploadToLocalFile(NewLockedUploaderPool(), deadLetters, dir,
+		finishURL, true, "", "tenant", nil, Config{IdleTimeout: time.Minute,
+			HandoverTimeout:        5 * time.Second,
+			HandoverConfirmTimeout: 50 * time.Millisecond})
+	if err = u.SetFileSize(5); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.ConsumeFileChunkAt(0, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-u.HandFileToApp(); err == nil {
+		t.Fatal("handover worked")
+	}
+	<-filenames
+
+	// the dead letter is left right after the handover is over
+	for i := 0; deadLetters.Size() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	letters := deadLetters.GetAll()
+	renamed := path.Join(dir, "renamed.txt")
+	if len(letters) != 1 || letters[0].FileName != renamed {
+		t.Fatalf("dead letters: %+v", letters)
+	}
+	if err = deadLetters.Replay(u.GetId(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if filename := <-filenames; filename != renamed {
+		t.Errorf("replayed handover has filename %q, want %q", filename,
+			renamed)
+	}
+	if _, err = os.Stat(renamed); !os.IsNotExist(err) {
+		t.Errorf("file is still there after replay: %v", err)
+	}
+}
+
+func TestDeadLetterDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "file")
+	batchDir := path.Join(dir, "batch")
+	if err = os.MkdirAll(batchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{file, path.Join(batchDir, "file")} {
+		if err = ioutil.WriteFile(p, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadLetters := NewDeadLetterList()
+	deadLetters.Add(&DeadLetter{Id: "file", FileName: file})
+	deadLetters.Add(&DeadLetter{Id: "batch", BatchId: "batch",
+		batchDir: batchDir})
+	for _, id := range []string{"file", "batch"} {
+		if err = deadLetters.Delete(id); err != nil {
+			t.Errorf("%s: %s", id, err)
+		}
+		if err = deadLetters.Delete(id); err == nil {
+			t.Errorf("%s: deleted twice", id)
+		}
+	}
+	if deadLetters.Size() != 0 {
+		t.Errorf("%d dead letters left", deadLetters.Size())
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left", len(entries))
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Incoming!! store of uploaded files, by content
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/uit-no/incoming/logging"
+)
+
+// DedupStore keeps uploaded files by the SHA-256 hash of their content, so
+// that a file we have seen before doesn't have to be uploaded again. Files in
+// the store are copies of the uploaded files, and files taken from the store
+// are copies of the files in the store, never hard links: app backends may
+// change the files they get in place without changing the store. The hash is
+// always computed by us, so a browser can't make us take a file for something
+// it isn't.
+type DedupStore struct {
+	dir string
+}
+
+// NewDedupStore makes a store in dir, creating dir if necessary. Files that
+// are in dir already are kept.
+func NewDedupStore(dir string) (*DedupStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DedupStore{dir: dir}, nil
+}
+
+// ValidHash tells whether hash looks like a hex-encoded SHA-256 hash, as used
+// by the store.
+func ValidHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// Place puts the file with the given hash and size at dst, if the store has
+// it. found is false if the store doesn't have the file.
+func (s *DedupStore) Place(hash string, size int64, dst string) (found bool,
+	err error) {
+	if !ValidHash(hash) {
+		return false, errors.New("not a SHA-256 hash")
+	}
+	src := path.Join(s.dir, hash)
+	info, err := os.Stat(src)
+	if err != nil || info.Size() != size {
+		return false, nil
+	}
+	err = copyFile(src, dst)
+	if err != nil {
+		return false, err
+	}
+
+	// the file is still in use, so it should stay in the store for a while
+	now := time.Now()
+	_ = os.Chtimes(src, now, now)
+	return true, nil
+}
+
+// Retain hashes the file at filePath, and keeps a copy of it in the store. It
+// returns the file's hash.
+func (s *DedupStore) Retain(filePath string) (hash string, err error) {
+	h := sha256.New()
+	tmp, err := copyToTemp(filePath, s.dir, h)
+	if err != nil {
+		return "", err
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+
+	dst := path.Join(s.dir, hash)
+	if _, err = os.Stat(dst); err == nil {
+		os.Remove(tmp)
+		now := time.Now()
+		_ = os.Chtimes(dst, now, now)
+		return hash, nil
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return hash, err
+}
+
+// Prune removes files that haven't been uploaded or taken from the store for
+// longer than maxAge.
+func (s *DedupStore) Prune(maxAge time.Duration) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		logging.Error("couldn't read dedup store", "dir", s.dir, "err", err)
+		return
+	}
+	for _, info := range infos {
+		if info.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		err = os.Remove(path.Join(s.dir, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			logging.Warn("couldn't remove file from dedup store",
+				"file", info.Name(), "err", err)
+		}
+	}
+}
+
+// linkOrCopy makes a hard link dst to src, or a copy of src at dst if the two
+// are on different file systems (or hard links don't work for other reasons).
+func linkOrCopy(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile makes a copy of src at dst. The copy is made under a temporary
+// name first, so that dst never is an incomplete file.
+func copyFile(src, dst string) error {
+	tmp, err := copyToTemp(src, path.Dir(dst), nil)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// copyToTemp copies src to a new file in dir, and returns the new file's
+// name. What is copied is written to h too, if h isn't nil.
+func copyToTemp(src, dir string, h io.Writer) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(dir, ".incoming-copy-")
+	if err != nil {
+		return "", err
+	}
+	var w io.Writer = out
+	if h != nil {
+		w = io.MultiWriter(out, h)
+	}
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
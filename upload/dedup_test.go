@@ -0,0 +1,91 @@
+/*
+Incoming!! tests for the store of uploaded files, by content
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDedupStoreKeepsCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewDedupStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("some file content")
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+	uploaded := path.Join(dir, "uploaded")
+	if err = ioutil.WriteFile(uploaded, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := s.Retain(uploaded)
+	if err != nil || hash != want {
+		t.Fatalf("Retain: got %q (%v), want %q", hash, err, want)
+	}
+
+	// the app backend changes the file it got in place
+	if err = ioutil.WriteFile(uploaded, []byte("changed!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// and changes the file it gets from the store, too
+	placed := path.Join(dir, "placed")
+	found, err := s.Place(hash, int64(len(data)), placed)
+	if !found || err != nil {
+		t.Fatalf("Place: found %v (%v)", found, err)
+	}
+	if got, _ := ioutil.ReadFile(placed); string(got) != string(data) {
+		t.Errorf("placed file has %q, want %q", got, data)
+	}
+	if err = ioutil.WriteFile(placed, []byte("changed!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(path.Join(dir, "store", hash))
+	if err != nil || string(got) != string(data) {
+		t.Errorf("store has %q (%v), want %q", got, err, data)
+	}
+	if found, _ = s.Place(hash, int64(len(data))+1, placed); found {
+		t.Errorf("Place found a file of the wrong size")
+	}
+
+	// retaining the same content again keeps the one copy
+	if err = ioutil.WriteFile(uploaded, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err = s.Retain(uploaded); err != nil || hash != want {
+		t.Errorf("Retain again: got %q (%v), want %q", hash, err, want)
+	}
+	entries, _ := ioutil.ReadDir(path.Join(dir, "store"))
+	if len(entries) != 1 {
+		t.Errorf("%d files in store, want 1", len(entries))
+	}
+}
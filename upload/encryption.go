@@ -0,0 +1,410 @@
+/*
+Incoming!! encryption of files at rest
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files have this format (all integers big endian):
+//
+//	header:   magic "INCENC1\x00" (8 bytes), segment size (uint32), size of
+//	          the plain file (uint64), length of the wrapped data key
+//	          (uint16), wrapped data key
+//	segments: the plain file in segments of segment size bytes (the last one
+//	          may be shorter), each one encrypted on its own with AES-256-GCM
+//	          and the data key: nonce (12 bytes), then ciphertext and tag.
+//	          The additional data is the segment's number (uint64, counting
+//	          from 0) and the size of the plain file (uint64), so segments
+//	          can't be swapped or cut off.
+//
+// Each upload has its own random data key. The data key is wrapped (encrypted
+// with AES-256-GCM) with the master key: nonce (12 bytes), then ciphertext
+// and tag, with encKeyAD as additional data.
+//
+// Since segments are encrypted on their own, they can be written in any
+// order, which is what resumed and parallel uploads need.
+const (
+	// EncryptionFormat names the format, for the app backend
+	EncryptionFormat = "incoming-aes256gcm-segments-v1"
+
+	encMagic       = "INCENC1\x00"
+	encSegmentSize = 64 * 1024
+	encKeyAD       = "incoming data key"
+)
+
+// Encryption encrypts files at rest with keys that are wrapped with a master
+// key.
+type Encryption struct {
+	master cipher.AEAD
+
+	// if true, files are handed over encrypted, together with the wrapped
+	// key. Otherwise, they are decrypted right before handover.
+	handOverKey bool
+}
+
+// ParseKey parses a hex encoded 256 bit key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key must be 64 hex digits (256 bits)")
+	}
+	return key, nil
+}
+
+// NewEncryption makes an Encryption with the given master key (256 bits). If
+// handOverKey is true, files are handed over encrypted, otherwise they are
+// decrypted before handover.
+func NewEncryption(masterKey []byte, handOverKey bool) (*Encryption, error) {
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Encryption{master: master, handOverKey: handOverKey}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with aead and a random nonce, and returns nonce and
+// ciphertext
+func seal(aead cipher.AEAD, plain, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+// open decrypts what seal has made
+func open(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], ad)
+}
+
+// newDataKey makes a random data key for one file, and returns it together
+// with its wrapped form.
+func (e *Encryption) newDataKey() (key, wrapped []byte, err error) {
+	key = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err = seal(e.master, key, []byte(encKeyAD))
+	return
+}
+
+// unwrapKey returns the data key from its wrapped form
+func (e *Encryption) unwrapKey(wrapped []byte) ([]byte, error) {
+	key, err := open(e.master, wrapped, []byte(encKeyAD))
+	if err != nil {
+		return nil, errors.New("couldn't unwrap data key: wrong master key?")
+	}
+	return key, nil
+}
+
+// encryptedFile writes a file in the encrypted format. Chunks of the plain
+// file can come in any order; a segment is encrypted and written as soon as
+// all of its bytes are here. Until then, its bytes are kept in memory.
+type encryptedFile struct {
+	aead       cipher.AEAD
+	size       int64 // of the plain file
+	wrappedKey []byte
+	headerSize int64
+
+	written rangeSet         // segments that are in the file
+	partial map[int64][]byte // segments we have some bytes of, by number
+	filled  map[int64]rangeSet
+}
+
+// newEncryptedFile makes an encryptedFile for a plain file of the given size,
+// with a new data key.
+func newEncryptedFile(enc *Encryption, size int64) (*encryptedFile, error) {
+	key, wrapped, err := enc.newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	f := &encryptedFile{aead: aead, size: size, wrappedKey: wrapped}
+	f.headerSize = int64(len(encMagic) + 4 + 8 + 2 + len(wrapped))
+	f.reset(nil)
+	return f, nil
+}
+
+// reset forgets all segments we have some bytes of, and takes written as the
+// segments that are in the file
+func (f *encryptedFile) reset(written rangeSet) {
+	f.written = written
+	f.partial = make(map[int64][]byte)
+	f.filled = make(map[int64]rangeSet)
+}
+
+// writeHeader writes the header to the beginning of fd
+func (f *encryptedFile) writeHeader(fd *os.File) error {
+	var buf bytes.Buffer
+	buf.WriteString(encMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(encSegmentSize))
+	binary.Write(&buf, binary.BigEndian, uint64(f.size))
+	binary.Write(&buf, binary.BigEndian, uint16(len(f.wrappedKey)))
+	buf.Write(f.wrappedKey)
+	_, err := fd.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+// readHeader reads the header of an encrypted file from in, and returns the
+// segment size, the size of the plain file, and the wrapped data key.
+func readHeader(in io.Reader) (segSize uint32, size uint64, wrapped []byte,
+	err error) {
+	var magic [len(encMagic)]byte
+	var keyLen uint16
+	_, err = io.ReadFull(in, magic[:])
+	if err == nil && string(magic[:]) != encMagic {
+		err = errors.New("not an encrypted file")
+	}
+	if err == nil {
+		err = binary.Read(in, binary.BigEndian, &segSize)
+	}
+	if err == nil {
+		err = binary.Read(in, binary.BigEndian, &size)
+	}
+	if err == nil {
+		err = binary.Read(in, binary.BigEndian, &keyLen)
+	}
+	if err == nil {
+		wrapped = make([]byte, keyLen)
+		_, err = io.ReadFull(in, wrapped)
+	}
+	if err != nil {
+		err = fmt.Errorf("couldn't read header of encrypted file: %s", err)
+	}
+	return
+}
+
+// openEncryptedFile makes an encryptedFile for the partial encrypted file at
+// path, with the data key from its header, to carry on writing it. written
+// are the segments that are in the file.
+func openEncryptedFile(enc *Encryption, path string, written rangeSet) (
+	*encryptedFile, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	segSize, size, wrapped, err := readHeader(in)
+	in.Close()
+	if err != nil {
+		return nil, err
+	}
+	if segSize != encSegmentSize {
+		return nil, fmt.Errorf("encrypted file has segments of %d bytes, "+
+			"not %d", segSize, encSegmentSize)
+	}
+	key, err := enc.unwrapKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	f := &encryptedFile{aead: aead, size: int64(size), wrappedKey: wrapped}
+	f.headerSize = int64(len(encMagic) + 4 + 8 + 2 + len(wrapped))
+	f.reset(written)
+	return f, nil
+}
+
+// segment returns where segment i starts and ends in the plain file
+func (f *encryptedFile) segment(i int64) (start, end int64) {
+	start = i * encSegmentSize
+	end = start + encSegmentSize
+	if end > f.size {
+		end = f.size
+	}
+	return
+}
+
+// segmentAD returns the additional data for segment i
+func segmentAD(i, size int64) []byte {
+	ad := make([]byte, 16)
+	binary.BigEndian.PutUint64(ad[0:8], uint64(i))
+	binary.BigEndian.PutUint64(ad[8:16], uint64(size))
+	return ad
+}
+
+// writeAt takes the chunk p of the plain file, starting at off. It returns
+// the segments that have been written to fd because of it. Bytes of segments
+// that have been written already are ignored.
+func (f *encryptedFile) writeAt(fd *os.File, p []byte, off int64) (
+	written []Range, err error) {
+	end := off + int64(len(p))
+	for i := off / encSegmentSize; i*encSegmentSize < end; i++ {
+		segStart, segEnd := f.segment(i)
+		if len(f.written.missing(segStart, segEnd)) == 0 {
+			continue
+		}
+
+		// copy what the chunk has of the segment
+		buf, ok := f.partial[i]
+		if !ok {
+			buf = make([]byte, segEnd-segStart)
+		}
+		from, to := segStart, segEnd
+		if off > from {
+			from = off
+		}
+		if end < to {
+			to = end
+		}
+		copy(buf[from-segStart:to-segStart], p[from-off:to-off])
+		filled := f.filled[i].add(from, to)
+		if filled.size() < segEnd-segStart {
+			f.partial[i] = buf
+			f.filled[i] = filled
+			continue
+		}
+
+		// the segment is complete: encrypt and write it
+		sealed, err := seal(f.aead, buf, segmentAD(i, f.size))
+		if err != nil {
+			return written, err
+		}
+		pos := f.headerSize +
+			i*int64(encSegmentSize+f.aead.NonceSize()+f.aead.Overhead())
+		_, err = fd.WriteAt(sealed, pos)
+		if err != nil {
+			return written, err
+		}
+		delete(f.partial, i)
+		delete(f.filled, i)
+		f.written = f.written.add(segStart, segEnd)
+		written = append(written, Range{segStart, segEnd})
+	}
+	return written, nil
+}
+
+// DecryptFile decrypts the encrypted file at src to dst, with the master key
+// the file's data key is wrapped with.
+func DecryptFile(masterKey []byte, src, dst string) error {
+	enc, err := NewEncryption(masterKey, false)
+	if err != nil {
+		return err
+	}
+	return enc.decryptFile(src, dst)
+}
+
+// decryptFile decrypts the encrypted file at src to dst. dst is written under
+// a temporary name first, so that it never is an incomplete file.
+func (e *Encryption) decryptFile(src, dst string) error {
+	tmp := dst + ".decrypting"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = e.decryptTo(src, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// openDecrypted returns a reader of the plain content of the encrypted file at
+// src. The file is decrypted as it is read; if it is damaged, reading fails.
+func (e *Encryption) openDecrypted(src string) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(e.decryptTo(src, w))
+	}()
+	return r
+}
+
+// decryptTo decrypts the encrypted file at src, and writes the plain file to
+// out.
+func (e *Encryption) decryptTo(src string, out io.Writer) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// read header
+	segSize, size, wrapped, err := readHeader(in)
+	if err != nil {
+		return err
+	}
+	key, err := e.unwrapKey(wrapped)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	// decrypt segments
+	sealed := make([]byte, int(segSize)+aead.NonceSize()+aead.Overhead())
+	for i, pos := int64(0), int64(0); pos < int64(size); i++ {
+		n := int64(segSize)
+		if int64(size)-pos < n {
+			n = int64(size) - pos
+		}
+		s := sealed[:int(n)+aead.NonceSize()+aead.Overhead()]
+		_, err = io.ReadFull(in, s)
+		if err != nil {
+			return fmt.Errorf("encrypted file is cut off: %s", err)
+		}
+		plain, err := open(aead, s, segmentAD(i, int64(size)))
+		if err != nil {
+			return fmt.Errorf("segment %d of encrypted file is damaged", i)
+		}
+		_, err = out.Write(plain)
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+/*
+Incoming!! tests for encryption of files at rest
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func testEncryption(t *testing.T) *Encryption {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := NewEncryption(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+// writeEncrypted writes data encrypted to a new file in dir, in chunks of
+// chunkSize bytes, last chunk first. It returns the file's path.
+func writeEncrypted(t *testing.T, enc *Encryption, dir string, data []byte,
+	chunkSize int) string {
+	f, err := newEncryptedFile(enc, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := ioutil.TempFile(dir, "enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err = f.writeHeader(fd); err != nil {
+		t.Fatal(err)
+	}
+	for end := len(data); end > 0; end -= chunkSize {
+		start := end - chunkSize
+		if start < 0 {
+			start = 0
+		}
+		if _, err = f.writeAt(fd, data[start:end], int64(start)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if missing := f.written.missing(0, int64(len(data))); len(missing) > 0 {
+		t.Fatalf("segments not written: %v", missing)
+	}
+	return fd.Name()
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	enc := testEncryption(t)
+
+	sizes := []int{0, 1, encSegmentSize - 1, encSegmentSize,
+		encSegmentSize + 1, 3 * encSegmentSize, 3*encSegmentSize + 1234}
+	for _, size := range sizes {
+		data := make([]byte, size)
+		rand.Read(data)
+		for _, chunkSize := range []int{1000, encSegmentSize, 100000} {
+			src := writeEncrypted(t, enc, dir, data, chunkSize)
+			dst := path.Join(dir, "plain")
+			if err := enc.decryptFile(src, dst); err != nil {
+				t.Fatalf("%d bytes in chunks of %d: %s", size, chunkSize, err)
+			}
+			plain, _ := ioutil.ReadFile(dst)
+			if !bytes.Equal(plain, data) {
+				t.Errorf("%d bytes in chunks of %d: decrypted file differs",
+					size, chunkSize)
+			}
+
+			r := enc.openDecrypted(src)
+			plain, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(plain, data) {
+				t.Errorf("%d bytes in chunks of %d: decrypted stream differs "+
+					"(%v)", size, chunkSize, err)
+			}
+		}
+	}
+}
+
+func TestEncryptionDamage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	enc := testEncryption(t)
+	data := make([]byte, 2*encSegmentSize+100)
+	rand.Read(data)
+	segSize := encSegmentSize + 12 + 16 // nonce and tag
+
+	tests := []struct {
+		name   string
+		damage func(b []byte) []byte
+	}{
+		{"truncated", func(b []byte) []byte { return b[:len(b)-1] }},
+		{"last segment cut off", func(b []byte) []byte {
+			return b[:len(b)-(100+12+16)]
+		}},
+		{"tampered", func(b []byte) []byte {
+			b[len(b)-segSize] ^= 1
+			return b
+		}},
+		{"segments swapped", func(b []byte) []byte {
+			first := len(b) - (100 + 12 + 16) - 2*segSize
+			swapped := append([]byte{}, b[:first]...)
+			swapped = append(swapped, b[first+segSize:first+2*segSize]...)
+			swapped = append(swapped, b[first:first+segSize]...)
+			return append(swapped, b[first+2*segSize:]...)
+		}},
+		{"wrong magic", func(b []byte) []byte {
+			b[0] ^= 1
+			return b
+		}},
+	}
+	for _, test := range tests {
+		src := writeEncrypted(t, enc, dir, data, encSegmentSize)
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(src, test.damage(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+		dst := path.Join(dir, "plain")
+		if err = enc.decryptFile(src, dst); err == nil {
+			t.Errorf("%s: decryption worked", test.name)
+		}
+		if _, err = os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("%s: decrypted file was left behind", test.name)
+		}
+		r := enc.openDecrypted(src)
+		if _, err = ioutil.ReadAll(r); err == nil {
+			t.Errorf("%s: reading decrypted stream worked", test.name)
+		}
+		r.Close()
+	}
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := writeEncrypted(t, testEncryption(t), dir, []byte("secret"), 10)
+	err = testEncryption(t).decryptFile(src, path.Join(dir, "plain"))
+	if err == nil {
+		t.Error("decryption with another master key worked")
+	}
+}
+
+func TestEncryptedParallelPause(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	enc := testEncryption(t)
+	data := make([]byte, 2*encSegmentSize)
+	rand.Read(data)
+	seg := int64(encSegmentSize)
+
+	finishURL, _ := url.Parse("http://localhost/finish")
+	conf := Config{IdleTimeout: time.Minute, PausedTimeout: time.Minute,
+		Encryption: enc, MaxConnections: 2}
+	u := newUploadToLocalFile(NewLockedUploaderPool(), nil, dir, finishURL,
+		true, "secret", "tenant", nil, conf, nil, 0, "")
+	if err = u.SetFileSize(int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.SetFileName("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Range{{0, seg}, {seg, 2 * seg}} {
+		if _, err = u.BindRangeToSocketHandler(r.Start, r.End); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both connections have some bytes of their segment when the client
+	// pauses on the first one
+	if err = u.ConsumeFileChunkAt(seg, data[seg:seg+100]); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.ConsumeFileChunkAt(0, data[:100]); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	u.UnbindRangeFromSocketHandler(0, seg)
+	if u.GetState() != StateUploading {
+		t.Errorf("upload is in state %d while a connection is still at work",
+			u.GetState())
+	}
+
+	// the second connection finishes its segment, which must not have lost
+	// its first bytes
+	if err = u.ConsumeFileChunkAt(seg+100, data[seg+100:]); err != nil {
+		t.Fatal(err)
+	}
+	if missing := u.GetMissingRanges(seg, 2*seg); len(missing) > 0 {
+		t.Errorf("missing %v of the second segment", missing)
+	}
+	u.UnbindRangeFromSocketHandler(seg, 2*seg)
+	if u.GetState() != StatePaused {
+		t.Errorf("upload is in state %d after the last connection is gone",
+			u.GetState())
+	}
+
+	// the client resumes, and sends the first segment again (its bytes were
+	// lost when the file was closed)
+	if _, err = u.BindRangeToSocketHandler(0, seg); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range u.GetMissingRanges(0, 2*seg) {
+		if err = u.ConsumeFileChunkAt(r.Start, data[r.Start:r.End]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	err = enc.decryptTo(path.Join(dir, u.GetId()), &buf)
+	if err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("file differs after resuming (%v)", err)
+	}
+}
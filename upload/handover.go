@@ -0,0 +1,174 @@
+/*
+Incoming!! handover replies from the app backend
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/uit-no/incoming/logging"
+)
+
+// the longest handover reply we read from the app backend
+const maxHandoverReplyBytes = 64 * 1024
+
+// longest wait between two attempts to hand a file over to the app backend
+const handoverMaxBackoff = 60 * time.Second
+
+const (
+	handoverActionDone = "done"
+	handoverActionWait = "wait"
+)
+
+// handoverReply is what the app backend answers to the 'file is here'
+// request. The backend can answer with plain text ("done" or "wait"), or with
+// a JSON object such as {"action":"wait","timeoutS":3600}.
+type handoverReply struct {
+	// "done" (backend has the file) or "wait" (backend will call
+	// finish_upload when it has the file)
+	Action string `json:"action"`
+
+	// for "wait": how long to wait for the backend's confirmation, in
+	// seconds (0: as in the upload's config)
+	TimeoutS uint `json:"timeoutS"`
+
+	// optional name the file should be renamed to (within the storage
+	// directory)
+	Filename string `json:"filename"`
+}
+
+// confirmTimeout returns how long to wait for the backend's confirmation,
+// given the upload's configured timeout
+func (r *handoverReply) confirmTimeout(def time.Duration) time.Duration {
+	if r.TimeoutS > 0 {
+		return time.Duration(r.TimeoutS) * time.Second
+	}
+	return def
+}
+
+// postHandover POSTs a 'file is here' request to the app backend. If the
+// backend can't be reached or answers with a server error, postHandover
+// retries with exponential backoff until retryWindow is used up. It returns
+// the backend's response (only if the status is 200, in which case the caller
+// must close the body), and how many attempts it took.
+func postHandover(htclient *http.Client, finishURL string, v url.Values,
+	retryWindow time.Duration,
+	log *logging.Logger) (resp *http.Response, attempts int, err error) {
+	start := time.Now()
+	backoff := time.Second
+	for {
+		attempts++
+		resp, err = htclient.PostForm(finishURL, v)
+		if err == nil && resp.StatusCode == 200 {
+			return
+		}
+
+		// set error if http went through but we got a bad http status back.
+		// Only some of those are worth trying again.
+		retry := true
+		if err == nil {
+			resp.Body.Close()
+			retry = resp.StatusCode >= 500 ||
+				resp.StatusCode == http.StatusRequestTimeout ||
+				resp.StatusCode == http.StatusTooManyRequests
+			err = fmt.Errorf("Got bad http status on handover: %s", resp.Status)
+			resp = nil
+		}
+
+		if !retry || time.Since(start)+backoff > retryWindow {
+			return
+		}
+		log.Warn("handover request failed, will retry", "err", err,
+			"attempt", attempts, "retryIn", backoff.String())
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > handoverMaxBackoff {
+			backoff = handoverMaxBackoff
+		}
+	}
+}
+
+// readHandoverReply reads and parses the app backend's reply to the 'file is
+// here' request. It closes the response body.
+func readHandoverReply(resp *http.Response) (*handoverReply, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHandoverReplyBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read reply from app backend: %s", err)
+	}
+	if len(body) > maxHandoverReplyBytes {
+		return nil, fmt.Errorf("reply from app backend is longer than %d bytes",
+			maxHandoverReplyBytes)
+	}
+	return parseHandoverReply(resp.Header.Get("Content-Type"), body)
+}
+
+// parseHandoverReply parses a handover reply. It is JSON if the content type
+// says so or if it looks like a JSON object, and plain text otherwise.
+func parseHandoverReply(contentType string, body []byte) (*handoverReply, error) {
+	body = bytes.TrimSpace(body)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	reply := new(handoverReply)
+	if mediaType == "application/json" || bytes.HasPrefix(body, []byte("{")) {
+		err := json.Unmarshal(body, reply)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse JSON reply from app backend: %s",
+				err)
+		}
+	} else {
+		reply.Action = string(body)
+	}
+
+	switch reply.Action {
+	case handoverActionDone, handoverActionWait:
+	default:
+		return nil, fmt.Errorf("don't understand reply from app backend: "+
+			"expected action 'done' or 'wait', got %q", abbreviate(reply.Action, 40))
+	}
+	if reply.Action == handoverActionDone && reply.TimeoutS > 0 {
+		return nil, fmt.Errorf("reply from app backend has timeoutS, but " +
+			"action is 'done'")
+	}
+	if reply.Filename != "" {
+		if strings.ContainsAny(reply.Filename, "/\\\x00") ||
+			reply.Filename == "." || reply.Filename == ".." {
+			return nil, fmt.Errorf("filename %q in reply from app backend is "+
+				"not a plain file name", abbreviate(reply.Filename, 40))
+		}
+	}
+	return reply, nil
+}
+
+// abbreviate cuts s to at most n bytes, for error messages
+func abbreviate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,94 @@
+/*
+Incoming!! tests for handing files over to the app backend
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"testing"
+)
+
+func TestParseHandoverReply(t *testing.T) {
+	const j = "application/json"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        *handoverReply // nil: refused
+	}{
+		{"text done", "text/plain", "done", &handoverReply{Action: "done"}},
+		{"text wait", "text/plain; charset=utf-8", "wait\n",
+			&handoverReply{Action: "wait"}},
+		{"text, no content type", "", " done ", &handoverReply{Action: "done"}},
+		{"text, unknown content type", "application/x-foo", "wait",
+			&handoverReply{Action: "wait"}},
+		{"text, bad content type", ";;;", "done",
+			&handoverReply{Action: "done"}},
+		{"text, unknown action", "text/plain", "ok", nil},
+		{"text, empty", "text/plain", "", nil},
+		{"html page", "text/html", "<html><body>done</body></html>", nil},
+		{"json done", j, `{"action": "done"}`, &handoverReply{Action: "done"}},
+		{"json wait", j, `{"action": "wait", "timeoutS": 30}`,
+			&handoverReply{Action: "wait", TimeoutS: 30}},
+		{"json with filename", j, `{"action": "done", "filename": "a.txt"}`,
+			&handoverReply{Action: "done", Filename: "a.txt"}},
+		{"json, charset", j + "; charset=utf-8", `{"action": "wait"}`,
+			&handoverReply{Action: "wait"}},
+		{"json, no content type", "", `{"action": "wait"}`,
+			&handoverReply{Action: "wait"}},
+		{"json, text content type", "text/plain", `{"action": "done"}`,
+			&handoverReply{Action: "done"}},
+		{"json, unknown action", j, `{"action": "later"}`, nil},
+		{"json, no action", j, `{"timeoutS": 30}`, nil},
+		{"json, done with timeout", j, `{"action": "done", "timeoutS": 30}`,
+			nil},
+		{"bad json", j, `{"action": "done"`, nil},
+		{"bad json, no content type", "", `{action: done}`, nil},
+		{"json content type, text body", j, "done", nil},
+		{"json, negative timeout", j, `{"action": "wait", "timeoutS": -1}`,
+			nil},
+		{"filename with slash", j, `{"action": "done", "filename": "a/b"}`,
+			nil},
+		{"filename with backslash", j,
+			`{"action": "done", "filename": "a\\b"}`, nil},
+		{"filename up", j, `{"action": "done", "filename": ".."}`, nil},
+		{"filename up and out", j,
+			`{"action": "done", "filename": "../etc/passwd"}`, nil},
+		{"filename dot", j, `{"action": "wait", "filename": "."}`, nil},
+		{"filename absolute", j, `{"action": "done", "filename": "/tmp/x"}`,
+			nil},
+		{"filename with NUL", j, `{"action": "done", "filename": "a\u0000b"}`,
+			nil},
+	}
+	for _, test := range tests {
+		got, err := parseHandoverReply(test.contentType, []byte(test.body))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %+v, want error", test.name, *got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if *got != *test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, *test.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Incoming!! journal of the byte ranges we have of a file
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// how often at most we append to a journal while uploading
+const journalFlushInterval = time.Second
+
+// size of a journal record: start and end of a range, big endian
+const journalRecordSize = 16
+
+// rangeJournal records which byte ranges of a file we have. It lives in a
+// sidecar file next to the file, and is a sequence of records, one for each
+// range that was written. A range is recorded only after it has been written
+// to the file, so when a paused upload is resumed, everything the journal
+// says we have is really in the file.
+//
+// Records are synced to disk together with the file (see flush), so this
+// holds after a crash of the server, too: such uploads are recovered at
+// startup (see RecoverUploads). A torn record at the end (from a failed
+// write) is ignored.
+type rangeJournal struct {
+	path      string
+	fd        *os.File
+	pending   rangeSet // written to the file, but not yet recorded
+	lastFlush time.Time
+}
+
+// createRangeJournal makes a new, empty journal at path.
+func createRangeJournal(path string) (*rangeJournal, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND,
+		0644)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeJournal{path: path, fd: fd, lastFlush: time.Now()}, nil
+}
+
+// openRangeJournal opens the journal at path, and returns it together with
+// the ranges it has recorded.
+func openRangeJournal(path string) (*rangeJournal, rangeSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var recorded rangeSet
+	for len(data) >= journalRecordSize {
+		start := int64(binary.BigEndian.Uint64(data[0:8]))
+		end := int64(binary.BigEndian.Uint64(data[8:16]))
+		recorded = recorded.add(start, end)
+		data = data[journalRecordSize:]
+	}
+
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	// cut off a torn record, so that new records are appended where they
+	// belong
+	if len(data) > 0 {
+		info, err := fd.Stat()
+		if err == nil {
+			err = fd.Truncate(info.Size() - int64(len(data)))
+		}
+		if err != nil {
+			fd.Close()
+			return nil, nil, err
+		}
+	}
+	return &rangeJournal{path: path, fd: fd, lastFlush: time.Now()}, recorded,
+		nil
+}
+
+// add notes that the range [start, end) has been written to the file. It is
+// recorded at the next flush.
+func (j *rangeJournal) add(start, end int64) {
+	j.pending = j.pending.add(start, end)
+}
+
+// flush records the pending ranges, if force is set or if it is time to do
+// so (see journalFlushInterval). The file the ranges were written to is
+// synced to disk first, and the journal after, so a record never gets to
+// disk before the data it is about.
+func (j *rangeJournal) flush(file *os.File, force bool) error {
+	if len(j.pending) == 0 ||
+		(!force && time.Since(j.lastFlush) < journalFlushInterval) {
+		return nil
+	}
+	err := file.Sync()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, len(j.pending)*journalRecordSize)
+	var rec [journalRecordSize]byte
+	for _, r := range j.pending {
+		binary.BigEndian.PutUint64(rec[0:8], uint64(r.Start))
+		binary.BigEndian.PutUint64(rec[8:16], uint64(r.End))
+		buf = append(buf, rec[:]...)
+	}
+	_, err = j.fd.Write(buf)
+	if err == nil {
+		err = j.fd.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	j.pending = nil
+	j.lastFlush = time.Now()
+	return nil
+}
+
+// close closes the journal, without recording pending ranges.
+func (j *rangeJournal) close() error {
+	return j.fd.Close()
+}
+
+// remove closes and deletes the journal.
+func (j *rangeJournal) remove() error {
+	j.fd.Close()
+	return os.Remove(j.path)
+}
@@ -0,0 +1,147 @@
+/*
+Incoming!! tests for journals of the ranges we have of a file
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// journalRecords encodes ranges the way a journal records them
+func journalRecords(ranges ...Range) []byte {
+	data := make([]byte, 0, len(ranges)*journalRecordSize)
+	var rec [journalRecordSize]byte
+	for _, r := range ranges {
+		binary.BigEndian.PutUint64(rec[0:8], uint64(r.Start))
+		binary.BigEndian.PutUint64(rec[8:16], uint64(r.End))
+		data = append(data, rec[:]...)
+	}
+	return data
+}
+
+func TestRangeJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jPath := path.Join(dir, "journal")
+	file, err := os.Create(path.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+		want rangeSet
+	}{
+		{"empty", nil, nil},
+		{"one record", journalRecords(Range{0, 10}), rangeSet{{0, 10}}},
+		{"records to merge", journalRecords(Range{20, 30}, Range{0, 10},
+			Range{10, 20}, Range{40, 50}), rangeSet{{0, 30}, {40, 50}}},
+		{"torn last record", append(journalRecords(Range{0, 10},
+			Range{20, 30}), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 40),
+			rangeSet{{0, 10}, {20, 30}}},
+		{"torn only record", []byte{0, 0, 0}, nil},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(jPath, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		j, recorded, err := openRangeJournal(jPath)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(recorded) != len(test.want) ||
+			(len(recorded) > 0 && !reflect.DeepEqual(recorded, test.want)) {
+			t.Errorf("%s: got %v, want %v", test.name, recorded, test.want)
+		}
+
+		// what is recorded from now on must be readable, even after a torn
+		// record
+		j.add(100, 110)
+		if err = j.flush(file, true); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		j.close()
+		_, recorded, err = openRangeJournal(jPath)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		want := append(append(rangeSet{}, test.want...), Range{100, 110})
+		if !reflect.DeepEqual(recorded, want) {
+			t.Errorf("%s, after append: got %v, want %v", test.name, recorded,
+				want)
+		}
+	}
+}
+
+func TestRangeJournalFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jPath := path.Join(dir, "journal")
+	file, err := os.Create(path.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	j, err := createRangeJournal(jPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.add(0, 10)
+	j.add(10, 20)
+	j.add(30, 40)
+
+	// too early for a flush that isn't forced
+	if err = j.flush(file, false); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(jPath); info.Size() != 0 {
+		t.Errorf("journal has %d bytes before flush", info.Size())
+	}
+
+	// pending ranges are merged before they are recorded
+	if err = j.flush(file, true); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(jPath)
+	want := journalRecords(Range{0, 20}, Range{30, 40})
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("journal has %v, want %v", data, want)
+	}
+
+	if err = j.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(jPath); !os.IsNotExist(err) {
+		t.Errorf("journal is still there after remove: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Incoming!! processing of uploaded files before handover
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uit-no/incoming/logging"
+)
+
+// kinds of processing steps
+const (
+	StepChecksum = "checksum" // hash of the file's content
+	StepMIME     = "mime"     // MIME type, sniffed from the file's content
+	StepSize     = "size"     // size of the file, checked against the upload
+	StepCommand  = "command"  // output of an external command
+)
+
+// how much output of a command step we take
+const maxStepOutput = 64 * 1024
+
+// names of processing steps become parts of handover field names
+var stepNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ProcessingStep is one step of the processing of files before handover. Its
+// result goes to the app backend with the handover.
+type ProcessingStep struct {
+	// name of the step, for the handover fields. Defaults to Kind.
+	Name string
+
+	// one of the Step* constants
+	Kind string
+
+	// for StepChecksum: "sha256" (default), "sha1" or "md5"
+	Algorithm string
+
+	// for StepCommand: the command, which gets the path of the file as its
+	// last argument. What it writes to stdout is the result. It fails if it
+	// exits with anything but 0, and it is killed if it writes more than 64
+	// KB to stdout or stderr.
+	Command []string
+
+	// for StepCommand: how long the command may take (0: forever)
+	Timeout time.Duration
+
+	// if true, the file is handed over even if the step fails. Otherwise, the
+	// upload is cancelled.
+	Optional bool
+}
+
+// Pipeline is the processing steps that run, in order, after a file has been
+// uploaded (and scanned) and before it is handed over.
+type Pipeline struct {
+	steps []ProcessingStep
+}
+
+// NewPipeline makes a Pipeline with the given steps, after checking them.
+func NewPipeline(steps []ProcessingStep) (*Pipeline, error) {
+	p := &Pipeline{steps: make([]ProcessingStep, len(steps))}
+	names := make(map[string]bool)
+	for i, step := range steps {
+		if step.Name == "" {
+			step.Name = step.Kind
+		}
+		if !stepNameRegexp.MatchString(step.Name) {
+			return nil, fmt.Errorf("processing step name %q is invalid, "+
+				"use letters, digits, '-' and '_'", step.Name)
+		}
+		if names[step.Name] {
+			return nil, fmt.Errorf("there is more than one processing step "+
+				"named %q", step.Name)
+		}
+		names[step.Name] = true
+
+		switch step.Kind {
+		case StepChecksum:
+			if step.Algorithm == "" {
+				step.Algorithm = "sha256"
+			}
+			if newHash(step.Algorithm) == nil {
+				return nil, fmt.Errorf("processing step %q: unknown checksum "+
+					"algorithm %q", step.Name, step.Algorithm)
+			}
+		case StepMIME, StepSize:
+		case StepCommand:
+			if len(step.Command) == 0 {
+				return nil, fmt.Errorf("processing step %q needs a command",
+					step.Name)
+			}
+		default:
+			return nil, fmt.Errorf("processing step %q: unknown kind %q",
+				step.Name, step.Kind)
+		}
+		p.steps[i] = step
+	}
+	return p, nil
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha256":
+		return sha256.New()
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// run runs all steps on the file at filePath, which should be size bytes
+// large. open gives the file's plain content. It returns the fields for the
+// app backend: "process.<name>" with the result of each step that worked, and
+// "process.<name>.error" with the reason for each step that failed. err is
+// set if a step that isn't optional failed; later steps don't run then.
+func (p *Pipeline) run(filePath string, size int64,
+	open func() (io.ReadCloser, error), log *logging.Logger) (fields url.Values,
+	err error) {
+	fields = url.Values{}
+	for _, step := range p.steps {
+		start := time.Now()
+		result, stepErr := step.run(filePath, size, open)
+		if stepErr != nil {
+			log.Warn("processing step failed", "step", step.Name, "err", stepErr)
+			fields.Set("process."+step.Name+".error", stepErr.Error())
+			if !step.Optional {
+				return fields, fmt.Errorf("processing step %s failed: %s",
+					step.Name, stepErr)
+			}
+			continue
+		}
+		log.Debug("processing step done", "step", step.Name,
+			"duration", time.Since(start).String())
+		fields.Set("process."+step.Name, result)
+	}
+	return fields, nil
+}
+
+func (s *ProcessingStep) run(filePath string, size int64,
+	open func() (io.ReadCloser, error)) (string, error) {
+	if s.Kind == StepCommand {
+		return s.runCommand(filePath)
+	}
+
+	r, err := open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	switch s.Kind {
+	case StepChecksum:
+		h := newHash(s.Algorithm)
+		if _, err = io.Copy(h, r); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	case StepMIME:
+		// DetectContentType looks at 512 bytes at most
+		head, err := ioutil.ReadAll(io.LimitReader(r, 512))
+		if err != nil {
+			return "", err
+		}
+		return http.DetectContentType(head), nil
+	case StepSize:
+		n, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return "", err
+		}
+		if n != size {
+			return "", fmt.Errorf("file has %d bytes, but %d were announced",
+				n, size)
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+	return "", fmt.Errorf("unknown kind of processing step %q", s.Kind)
+}
+
+func (s *ProcessingStep) runCommand(filePath string) (string, error) {
+	// the command is killed when it times out, or when it writes too much
+	ctx, kill := context.WithCancel(context.Background())
+	defer kill()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	args := append(append([]string{}, s.Command[1:]...), filePath)
+	cmd := exec.CommandContext(ctx, s.Command[0], args...)
+	stdout := &limitedBuffer{max: maxStepOutput, overflow: kill}
+	stderr := &limitedBuffer{max: maxStepOutput, overflow: kill}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if stdout.overflowed || stderr.overflowed {
+		return "", errTooMuchOutput
+	}
+	if err != nil {
+		// the first line of what the command complains about tells most
+		line, _ := bufio.NewReader(&stderr.buf).ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			return "", fmt.Errorf("%s: %s", err, line)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.buf.String()), nil
+}
+
+var errTooMuchOutput = errors.New("command wrote too much output")
+
+// limitedBuffer is a buffer for the output of a command, which takes up to
+// max bytes. Writing more fails and calls overflow (which kills the command),
+// instead of us keeping all it writes.
+type limitedBuffer struct {
+	buf        bytes.Buffer // not embedded, io.Copy would use its ReadFrom
+	max        int
+	overflow   func()
+	overflowed bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		if !b.overflowed {
+			b.overflowed = true
+			b.overflow()
+		}
+		return 0, errTooMuchOutput
+	}
+	return b.buf.Write(p)
+}
@@ -0,0 +1,134 @@
+/*
+Incoming!! tests for processing of uploaded files
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestProcessingSteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("hello\n")
+	filePath := path.Join(dir, "file")
+	if err = ioutil.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	open := func() (io.ReadCloser, error) {
+		return readCloser{bytes.NewReader(data)}, nil
+	}
+
+	tests := []struct {
+		step   ProcessingStep
+		size   int64
+		result string
+		fails  bool
+	}{
+		{ProcessingStep{Kind: StepChecksum, Algorithm: "sha256"}, 6,
+			"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+			false},
+		{ProcessingStep{Kind: StepChecksum, Algorithm: "md5"}, 6,
+			"b1946ac92492d2347c6235b4d2611184", false},
+		{ProcessingStep{Kind: StepMIME}, 6, "text/plain; charset=utf-8", false},
+		{ProcessingStep{Kind: StepSize}, 6, "6", false},
+		{ProcessingStep{Kind: StepSize}, 7, "", true},
+		{ProcessingStep{Kind: StepCommand, Command: []string{"cat"}}, 6,
+			"hello", false},
+		{ProcessingStep{Kind: StepCommand, Command: []string{"false"}}, 6, "",
+			true},
+		{ProcessingStep{Kind: StepCommand, Command: []string{"sleep", "10"},
+			Timeout: 100 * time.Millisecond}, 6, "", true},
+	}
+	for _, test := range tests {
+		result, err := test.step.run(filePath, test.size, open)
+		if test.fails != (err != nil) || result != test.result {
+			t.Errorf("%+v: got %q, error %v", test.step, result, err)
+		}
+	}
+}
+
+func TestCommandOutputLimit(t *testing.T) {
+	// the command ignores that its writes fail, and would run forever
+	step := ProcessingStep{Kind: StepCommand, Command: []string{"sh", "-c",
+		"trap '' PIPE; while :; do echo xxxxxxxxxxxxxxxx; done 2>/dev/null",
+		"sh"}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := step.runCommand("unused")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != errTooMuchOutput {
+			t.Errorf("got error %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("command wasn't killed")
+	}
+}
+
+func TestProcessEmptyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pipeline, err := NewPipeline([]ProcessingStep{{Name: "exists",
+		Kind: StepCommand, Command: []string{"test", "-f"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forms := make(chan url.Values, 1)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			forms <- r.PostForm
+			fmt.Fprint(w, "done")
+		}))
+	defer backend.Close()
+	finishURL, _ := url.Parse(backend.URL)
+
+	u := NewUploadToLocalFile(NewLockedUploaderPool(), nil, dir, finishURL,
+		false, "", "tenant", nil, Config{IdleTimeout: time.Minute,
+			HandoverTimeout: 5 * time.Second, Processing: pipeline})
+	if err = u.SetFileSize(0); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-u.HandFileToApp(); err != nil {
+		t.Fatalf("handover failed: %s", err)
+	}
+	form := <-forms
+	if _, ok := form["process.exists"]; !ok {
+		t.Errorf("command didn't get the file: %v", form)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Incoming!! byte ranges of a file
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+// Range is a range of bytes in a file, from Start up to (but not including)
+// End.
+type Range struct {
+	Start int64
+	End   int64
+}
+
+// rangeSet is a set of byte ranges, kept sorted and merged: no two ranges in
+// the set overlap or touch.
+type rangeSet []Range
+
+// add puts the range [start, end) into the set.
+func (s rangeSet) add(start, end int64) rangeSet {
+	if start >= end {
+		return s
+	}
+	res := make(rangeSet, 0, len(s)+1)
+	added := false
+	for _, r := range s {
+		switch {
+		case r.End < start:
+			res = append(res, r)
+		case end < r.Start:
+			if !added {
+				res = append(res, Range{start, end})
+				added = true
+			}
+			res = append(res, r)
+		default:
+			// overlaps or touches: merge into the new range
+			if r.Start < start {
+				start = r.Start
+			}
+			if r.End > end {
+				end = r.End
+			}
+		}
+	}
+	if !added {
+		res = append(res, Range{start, end})
+	}
+	return res
+}
+
+// size returns how many bytes the set covers.
+func (s rangeSet) size() (n int64) {
+	for _, r := range s {
+		n += r.End - r.Start
+	}
+	return
+}
+
+// missing returns the ranges within [start, end) that are not in the set.
+func (s rangeSet) missing(start, end int64) (res []Range) {
+	pos := start
+	for _, r := range s {
+		if r.End <= pos {
+			continue
+		}
+		if r.Start >= end {
+			break
+		}
+		if r.Start > pos {
+			res = append(res, Range{pos, r.Start})
+		}
+		pos = r.End
+	}
+	if pos < end {
+		res = append(res, Range{pos, end})
+	}
+	return
+}
@@ -0,0 +1,96 @@
+/*
+Incoming!! tests for sets of byte ranges
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRangeSetAdd(t *testing.T) {
+	tests := []struct {
+		name  string
+		add   []Range
+		want  rangeSet
+		bytes int64
+	}{
+		{"empty", nil, nil, 0},
+		{"one", []Range{{0, 10}}, rangeSet{{0, 10}}, 10},
+		{"empty range", []Range{{5, 5}, {7, 3}}, nil, 0},
+		{"apart, in order", []Range{{0, 10}, {20, 30}},
+			rangeSet{{0, 10}, {20, 30}}, 20},
+		{"apart, out of order", []Range{{20, 30}, {0, 10}, {40, 50}},
+			rangeSet{{0, 10}, {20, 30}, {40, 50}}, 30},
+		{"touching", []Range{{0, 10}, {10, 20}}, rangeSet{{0, 20}}, 20},
+		{"touching before", []Range{{10, 20}, {0, 10}}, rangeSet{{0, 20}}, 20},
+		{"overlapping", []Range{{0, 10}, {5, 15}}, rangeSet{{0, 15}}, 15},
+		{"contained", []Range{{0, 20}, {5, 10}}, rangeSet{{0, 20}}, 20},
+		{"containing", []Range{{5, 10}, {0, 20}}, rangeSet{{0, 20}}, 20},
+		{"twice", []Range{{0, 10}, {0, 10}}, rangeSet{{0, 10}}, 10},
+		{"filling a gap", []Range{{0, 10}, {20, 30}, {10, 20}},
+			rangeSet{{0, 30}}, 30},
+		{"spanning several", []Range{{0, 5}, {10, 15}, {20, 25}, {40, 50},
+			{3, 22}}, rangeSet{{0, 25}, {40, 50}}, 35},
+	}
+	for _, test := range tests {
+		var s rangeSet
+		for _, r := range test.add {
+			s = s.add(r.Start, r.End)
+		}
+		if len(s) != len(test.want) ||
+			(len(s) > 0 && !reflect.DeepEqual(s, test.want)) {
+			t.Errorf("%s: got %v, want %v", test.name, s, test.want)
+		}
+		if s.size() != test.bytes {
+			t.Errorf("%s: size is %d, want %d", test.name, s.size(), test.bytes)
+		}
+	}
+}
+
+func TestRangeSetMissing(t *testing.T) {
+	s := rangeSet{{10, 20}, {30, 40}}
+	tests := []struct {
+		start, end int64
+		want       []Range
+	}{
+		{0, 50, []Range{{0, 10}, {20, 30}, {40, 50}}},
+		{10, 40, []Range{{20, 30}}},
+		{12, 18, nil},
+		{15, 35, []Range{{20, 30}}},
+		{0, 10, []Range{{0, 10}}},
+		{40, 50, []Range{{40, 50}}},
+		{20, 30, []Range{{20, 30}}},
+		{5, 5, nil},
+	}
+	for _, test := range tests {
+		got := s.missing(test.start, test.end)
+		if len(got) != len(test.want) ||
+			(len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+			t.Errorf("missing(%d, %d): got %v, want %v", test.start, test.end,
+				got, test.want)
+		}
+	}
+
+	var empty rangeSet
+	got := empty.missing(0, 10)
+	if !reflect.DeepEqual(got, []Range{{0, 10}}) {
+		t.Errorf("missing of empty set: got %v", got)
+	}
+}
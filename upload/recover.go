@@ -0,0 +1,283 @@
+/*
+Incoming!! recovery of uploads after a restart
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/uit-no/incoming/logging"
+)
+
+// suffixes of the files of a partial upload in the storage directory: the
+// file itself, its journal, and the upload's record
+const (
+	partSuffix    = ".part"
+	journalSuffix = ".ranges"
+	recordSuffix  = ".ticket"
+)
+
+// uploadRecord is what we need to know about an upload, besides its file and
+// journal, to recover it after a restart. It is written next to the partial
+// file when the first chunk arrives, and removed with the file.
+type uploadRecord struct {
+	Tenant                 string
+	SignalFinishURL        string
+	BackendSecret          string
+	Metadata               map[string]string
+	RemoveFileWhenFinished bool
+	Overrides              ConfigOverrides
+	Reloadable             bool
+
+	FileSize        int64
+	Name            string
+	MimeType        string
+	LastModified    time.Time
+	Encrypted       bool
+	CreationTime    time.Time
+	UploadStartTime time.Time
+}
+
+// recordPath returns where the record of the (partial) file is
+func (u *UploadToLocalFile) recordPath() string {
+	return u.path + recordSuffix
+}
+
+// writeRecord writes the upload's record, and makes sure that it, the
+// partial file and the journal are on disk. The caller must hold the lock.
+func (u *UploadToLocalFile) writeRecord() error {
+	rec := uploadRecord{
+		Tenant:                 u.tenant,
+		SignalFinishURL:        u.signalFinishURL.String(),
+		BackendSecret:          u.backendSecret,
+		Metadata:               u.ticketMetadata,
+		RemoveFileWhenFinished: u.removeFileWhenFinished,
+		Overrides:              u.config.Overrides,
+		Reloadable:             u.config.Reloadable,
+		FileSize:               u.fileSize,
+		Name:                   u.nameFromBrowser,
+		MimeType:               u.mimeTypeFromBrowser,
+		LastModified:           u.lastModifiedFromBrowser,
+		Encrypted:              u.crypt != nil,
+		CreationTime:           u.creationTime,
+		UploadStartTime:        u.uploadStartTime,
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	// the record has the backend secret, so only we may read it
+	out, err := ioutil.TempFile(u.dir, ".incoming-record-")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), u.recordPath())
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return syncDir(u.dir)
+}
+
+// syncDir makes sure that the directory entries in dir are on disk
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// recoverableFiles returns the names of those files in the storage directory
+// that belong to partial uploads which can be recovered: those with a file,
+// a journal and a record.
+func recoverableFiles(entries []os.FileInfo) map[string]bool {
+	regular := make(map[string]bool)
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			regular[e.Name()] = true
+		}
+	}
+	keep := make(map[string]bool)
+	for name := range regular {
+		if !strings.HasSuffix(name, partSuffix+recordSuffix) {
+			continue
+		}
+		part := strings.TrimSuffix(name, recordSuffix)
+		if regular[part] && regular[part+journalSuffix] {
+			keep[name] = true
+			keep[part] = true
+			keep[part+journalSuffix] = true
+		}
+	}
+	return keep
+}
+
+// RecoverUploads recovers the partial uploads in storageDir, which InitModule
+// has left there, and returns their uploaders. conf is the default upload
+// config, to which each upload's overrides are applied. A recovered upload
+// keeps its id, and is paused with what its journal says we have of the
+// file, so the browser can resume it like after any other pause.
+//
+// Only uploads of their own (not files of a batch) that had received their
+// first chunk are recovered, and the event subscription of their ticket is
+// lost. Uploads that can't be recovered are removed.
+func RecoverUploads(pool UploaderPool, deadLetters *DeadLetterList,
+	storageDir string, conf Config) []Uploader {
+	entries, err := ioutil.ReadDir(storageDir)
+	if err != nil {
+		logging.Error("couldn't look for uploads to recover", "dir", storageDir,
+			"err", err)
+		return nil
+	}
+
+	var recovered []Uploader
+	for name := range recoverableFiles(entries) {
+		if !strings.HasSuffix(name, partSuffix+recordSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(name, partSuffix+recordSuffix)
+		u, err := recoverUpload(pool, deadLetters, storageDir, conf, id)
+		if err != nil {
+			logging.Warn("couldn't recover upload", "upload", id, "err", err)
+			partPath := path.Join(storageDir, id+partSuffix)
+			os.Remove(partPath)
+			os.Remove(partPath + journalSuffix)
+			os.Remove(partPath + recordSuffix)
+			continue
+		}
+		recovered = append(recovered, u)
+	}
+	return recovered
+}
+
+// recoverUpload recovers the partial upload with the given id from its file,
+// journal and record in storageDir.
+func recoverUpload(pool UploaderPool, deadLetters *DeadLetterList,
+	storageDir string, conf Config, id string) (*UploadToLocalFile, error) {
+	partPath := path.Join(storageDir, id+partSuffix)
+	data, err := ioutil.ReadFile(partPath + recordSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var rec uploadRecord
+	err = json.Unmarshal(data, &rec)
+	if err != nil {
+		return nil, fmt.Errorf("record is damaged: %s", err)
+	}
+	signalFinishURL, err := url.ParseRequestURI(rec.SignalFinishURL)
+	if err != nil {
+		return nil, fmt.Errorf("record is damaged: %s", err)
+	}
+	journal, recorded, err := openRangeJournal(partPath + journalSuffix)
+	if err != nil {
+		return nil, err
+	}
+	journal.close()
+	if len(recorded) > 0 && (recorded[0].Start < 0 ||
+		recorded[len(recorded)-1].End > rec.FileSize) {
+		return nil, errors.New("journal doesn't fit the file")
+	}
+
+	// the upload runs with the config it would get from its ticket now, and
+	// is encrypted if (and only if) it was before
+	c := rec.Overrides.Apply(conf)
+	c.Reloadable = rec.Reloadable
+	var crypt *encryptedFile
+	if rec.Encrypted {
+		if c.Encryption == nil {
+			return nil, errors.New("file is encrypted, but encryption is off")
+		}
+		crypt, err = openEncryptedFile(c.Encryption, partPath, recorded)
+		if err != nil {
+			return nil, err
+		}
+		if crypt.size != rec.FileSize {
+			return nil, errors.New("encrypted file doesn't fit the record")
+		}
+	} else {
+		c.Encryption = nil
+	}
+
+	u := newUploadToLocalFile(pool, deadLetters, storageDir, signalFinishURL,
+		rec.RemoveFileWhenFinished, rec.BackendSecret, rec.Tenant, rec.Metadata,
+		c, nil, 0, id)
+	if u == nil {
+		return nil, errors.New("id is in use")
+	}
+
+	u.lock.Lock()
+	u.creationTime = rec.CreationTime
+	u.uploadStartTime = rec.UploadStartTime
+	u.startClaimed = true // reported before the restart
+	u.nameFromBrowser = rec.Name
+	u.mimeTypeFromBrowser = rec.MimeType
+	u.lastModifiedFromBrowser = rec.LastModified
+	u.fileSize = rec.FileSize
+	u.fileSizeSet = true
+	u.path = partPath
+	u.crypt = crypt
+	u.received = recorded
+	u.filePos = recorded.size()
+	u.sessions = 1 // the browser reconnects, it doesn't start over
+
+	// we might have crashed after the last chunk arrived, but before the file
+	// got its final name
+	if u.filePos == u.fileSize {
+		u.uploadEndTime = time.Now()
+		os.Remove(u.journalPath())
+		err = u.completeFile()
+	}
+	u.lock_state.Lock()
+	u.state = StatePaused
+	u.lock_state.Unlock()
+	u.resetTimeout(u.timeoutForState())
+	u.lock.Unlock()
+
+	if err != nil {
+		u.Cancel(false, "couldn't recover upload", 0)
+		u.CleanUp()
+		return nil, err
+	}
+	u.log.Info("recovered upload", "filePos", u.GetFilePos(),
+		"fileSize", rec.FileSize)
+	return u, nil
+}
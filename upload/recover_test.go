@@ -0,0 +1,218 @@
+/*
+Incoming!! tests for recovery of uploads after a restart
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+// crashedUpload starts an upload in dir, uploads the given ranges of data,
+// and leaves it behind the way a crash of the server would (after the
+// journal was flushed). It returns the upload's id.
+func crashedUpload(t *testing.T, dir string, conf Config, data []byte,
+	ranges []Range) string {
+	finishURL, _ := url.Parse("http://localhost/finish")
+	u := newUploadToLocalFile(NewLockedUploaderPool(), nil, dir, finishURL,
+		true, "secret", "tenant", map[string]string{"key": "value"}, conf, nil,
+		0, "")
+	if err := u.SetFileSize(int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetFileName("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range ranges {
+		if err := u.ConsumeFileChunkAt(r.Start, data[r.Start:r.End]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u.lock.Lock()
+	if u.journal != nil {
+		if err := u.journal.flush(u.fd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u.lock.Unlock()
+	return u.id
+}
+
+func TestRecoverUploads(t *testing.T) {
+	enc := testEncryption(t)
+	data := make([]byte, 3*encSegmentSize+100)
+	rand.Read(data)
+	size := int64(len(data))
+	half := int64(encSegmentSize + 10)
+
+	tests := []struct {
+		name   string
+		enc    *Encryption // of the upload
+		encNow *Encryption // after the restart
+		ranges []Range
+		pos    int64 // how much the recovered upload has, -1: not recovered
+		last   bool  // the last byte is in the file, but it wasn't renamed
+	}{
+		{"plain", nil, nil, []Range{{0, half}}, half, false},
+		{"plain, out of order", nil, nil, []Range{{half, 2 * half}, {0, 10}},
+			half + 10, false},
+		{"plain, encryption on now", nil, enc, []Range{{0, half}}, half, false},
+		{"plain, complete", nil, nil, []Range{{0, size - 1}}, size, true},
+		// only whole segments are in an encrypted file
+		{"encrypted", enc, enc, []Range{{0, half}}, encSegmentSize, false},
+		{"encrypted, encryption off now", enc, nil, []Range{{0, half}}, -1,
+			false},
+		{"encrypted, other key now", enc, testEncryption(t),
+			[]Range{{0, half}}, -1, false},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "incoming-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		conf := Config{IdleTimeout: time.Minute, Encryption: test.enc}
+		id := crashedUpload(t, dir, conf, data, test.ranges)
+		if test.last {
+			partPath := path.Join(dir, id+partSuffix)
+			fd, err := os.OpenFile(partPath, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd.WriteAt(data[size-1:], size-1)
+			fd.Close()
+			fd, err = os.OpenFile(partPath+journalSuffix,
+				os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd.Write(journalRecords(Range{size - 1, size}))
+			fd.Close()
+		}
+
+		// restart
+		if err = initStorageDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		pool := NewLockedUploaderPool()
+		conf.Encryption = test.encNow
+		recovered := RecoverUploads(pool, nil, dir, conf)
+		if test.pos < 0 {
+			if len(recovered) != 0 {
+				t.Errorf("%s: upload was recovered", test.name)
+			}
+			if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("%s: %d files left behind", test.name, len(entries))
+			}
+			continue
+		}
+		if len(recovered) != 1 || recovered[0].GetId() != id {
+			t.Errorf("%s: recovered %v", test.name, recovered)
+			continue
+		}
+		u, ok := pool.Get(id)
+		if !ok {
+			t.Errorf("%s: recovered upload isn't in the pool", test.name)
+			continue
+		}
+		if u.GetState() != StatePaused || u.GetFilePos() != test.pos ||
+			u.GetFileName() != "file.txt" || u.GetBackendSecret() != "secret" ||
+			u.GetMetadata()["key"] != "value" {
+			t.Errorf("%s: recovered upload is in state %d with %d bytes",
+				test.name, u.GetState(), u.GetFilePos())
+		}
+		if u.ClaimStart() {
+			t.Errorf("%s: recovered upload can claim its start again",
+				test.name)
+		}
+
+		// the browser comes back and uploads what is missing
+		if err = u.SetFileSize(size); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		for _, r := range u.GetMissingRanges(0, size) {
+			err = u.ConsumeFileChunkAt(r.Start, data[r.Start:r.End])
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		file := path.Join(dir, id)
+		var got []byte
+		if test.enc != nil {
+			var buf bytes.Buffer
+			err = test.enc.decryptTo(file, &buf)
+			got = buf.Bytes()
+		} else {
+			got, err = ioutil.ReadFile(file)
+		}
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: file differs after resuming (%v)", test.name, err)
+		}
+		entries, _ := ioutil.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Errorf("%s: %d files in storage dir, want 1", test.name,
+				len(entries))
+		}
+	}
+}
+
+func TestInitStorageDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"a.part", "a.part.ranges", "a.part.ticket", // recoverable
+		"b.part", "b.part.ticket", // no journal
+		"c.part.ranges", "c.part.ticket", // no file
+		"d", "e.part", ".incoming-record-1",
+	}
+	for _, name := range files {
+		if err = ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.MkdirAll(path.Join(dir, "batch", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = initStorageDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	sort.Strings(left)
+	want := []string{"a.part", "a.part.ranges", "a.part.ticket"}
+	if len(left) != len(want) || left[0] != want[0] || left[1] != want[1] ||
+		left[2] != want[2] {
+		t.Errorf("left in storage dir: %v, want %v", left, want)
+	}
+}
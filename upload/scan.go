@@ -0,0 +1,211 @@
+/*
+Incoming!! scanning of uploaded files for viruses and other malware
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// what happens to files that are infected (or can't be scanned)
+const (
+	ScanPolicyCancel     = "cancel"     // cancel the upload, delete the file
+	ScanPolicyQuarantine = "quarantine" // cancel the upload, keep the file
+	ScanPolicyFlag       = "flag"       // hand the file over, and say so
+)
+
+// scan results, as the app backend gets them
+const (
+	scanResultClean    = "clean"
+	scanResultInfected = "infected"
+	scanResultError    = "error"
+)
+
+// how much of a file we send to clamd at once
+const clamdChunkSize = 64 * 1024
+
+// Scanner scans files before they are handed over, either with an external
+// command or with clamd.
+//
+// The command gets the path of the file as its last argument. It must exit
+// with 0 if the file is clean, and with 1 if it is infected, in which case the
+// first line of its output names what was found (clamscan and clamdscan work
+// that way). Any other exit status means that scanning failed.
+//
+// clamd is given the file's content with its INSTREAM command, so it doesn't
+// need access to our files.
+type Scanner struct {
+	command       []string
+	clamdAddress  string
+	timeout       time.Duration
+	policy        string
+	quarantineDir string
+}
+
+// NewScanner makes a Scanner that runs command, or talks to clamd at
+// clamdAddress (a unix socket if it starts with "/", host:port otherwise).
+// Exactly one of the two must be given. policy is one of the ScanPolicy
+// constants; for ScanPolicyQuarantine, files are moved to quarantineDir.
+func NewScanner(command []string, clamdAddress string, timeout time.Duration,
+	policy string, quarantineDir string) (*Scanner, error) {
+	if (len(command) == 0) == (clamdAddress == "") {
+		return nil, errors.New("need either a scan command or a clamd address")
+	}
+	switch policy {
+	case ScanPolicyCancel, ScanPolicyFlag:
+	case ScanPolicyQuarantine:
+		if quarantineDir == "" {
+			return nil, errors.New("quarantine policy needs a quarantine directory")
+		}
+		err := os.MkdirAll(quarantineDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown scan policy %q", policy)
+	}
+	return &Scanner{command: command, clamdAddress: clamdAddress,
+		timeout: timeout, policy: policy, quarantineDir: quarantineDir}, nil
+}
+
+// scanResult is the outcome of scanning a file
+type scanResult struct {
+	infected  bool
+	signature string // what was found, if infected
+}
+
+// scan scans the file at filePath. open gives the file's content, which is
+// needed for clamd.
+func (s *Scanner) scan(filePath string,
+	open func() (io.ReadCloser, error)) (res scanResult, err error) {
+	if len(s.command) > 0 {
+		return s.scanWithCommand(filePath)
+	}
+	r, err := open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	return s.scanWithClamd(r)
+}
+
+func (s *Scanner) scanWithCommand(filePath string) (res scanResult, err error) {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	args := append(append([]string{}, s.command[1:]...), filePath)
+	out, err := exec.CommandContext(ctx, s.command[0], args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		line, _ := bufio.NewReader(bytes.NewReader(out)).ReadString('\n')
+		res.infected = true
+		res.signature = strings.TrimSpace(line)
+		return res, nil
+	}
+	if err != nil {
+		return res, fmt.Errorf("scan command failed: %s", err)
+	}
+	return res, nil
+}
+
+func (s *Scanner) scanWithClamd(r io.Reader) (res scanResult, err error) {
+	network := "tcp"
+	if strings.HasPrefix(s.clamdAddress, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, s.clamdAddress, 10*time.Second)
+	if err != nil {
+		return res, fmt.Errorf("couldn't connect to clamd: %s", err)
+	}
+	defer conn.Close()
+	if s.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	// send the file in chunks, each with its length, and a zero length chunk
+	// at the end
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	buf := make([]byte, 4+clamdChunkSize)
+	for err == nil {
+		var n int
+		n, err = io.ReadFull(r, buf[4:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+			if n == 0 {
+				break
+			}
+		} else if err != nil {
+			return res, fmt.Errorf("couldn't read file: %s", err)
+		}
+		binary.BigEndian.PutUint32(buf[:4], uint32(n))
+		_, err = conn.Write(buf[:4+n])
+		if n < clamdChunkSize {
+			break
+		}
+	}
+	if err == nil {
+		_, err = conn.Write([]byte{0, 0, 0, 0})
+	}
+	if err != nil {
+		return res, fmt.Errorf("couldn't send file to clamd: %s", err)
+	}
+
+	// clamd answers "stream: OK", "stream: <signature> FOUND", or
+	// "<something> ERROR"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return res, fmt.Errorf("no reply from clamd: %s", err)
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return res, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		res.infected = true
+		res.signature = strings.TrimSuffix(reply, " FOUND")
+		return res, nil
+	default:
+		return res, fmt.Errorf("clamd couldn't scan file: %s", reply)
+	}
+}
+
+// RejectedError is the outcome of a handover that didn't happen because
+// scanning found (or couldn't rule out) that the file is infected, or because
+// a processing step failed.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return e.Reason
+}
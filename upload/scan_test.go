@@ -0,0 +1,220 @@
+/*
+Incoming!! tests for scanning of uploaded files
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubClamd listens like clamd does, takes one INSTREAM command per
+// connection, and answers it with reply (without the terminating NUL). If
+// reply is empty, it closes the connection without answering. What it got is
+// sent to the returned channel.
+func stubClamd(t *testing.T, reply string) (net.Listener, <-chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			got <- readInstream(conn)
+			if reply != "" {
+				conn.Write([]byte(reply + "\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return l, got
+}
+
+// readInstream reads an INSTREAM command and the chunks that follow it, and
+// returns the data of the chunks (nil if the command is wrong).
+func readInstream(conn net.Conn) []byte {
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil || cmd != "zINSTREAM\x00" {
+		return nil
+	}
+	data := []byte{}
+	for {
+		var n uint32
+		if binary.Read(r, binary.BigEndian, &n) != nil || n == 0 {
+			return data
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return data
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func TestScanWithClamd(t *testing.T) {
+	tests := []struct {
+		name      string
+		reply     string
+		infected  bool
+		signature string
+		fails     bool
+	}{
+		{"clean", "stream: OK", false, "", false},
+		{"infected", "stream: Eicar-Test-Signature FOUND", true,
+			"Eicar-Test-Signature", false},
+		{"size limit", "INSTREAM size limit exceeded. ERROR", false, "", true},
+		{"no reply", "", false, "", true},
+	}
+	sizes := []int{0, 10, clamdChunkSize, 2*clamdChunkSize + 7}
+
+	for _, test := range tests {
+		l, got := stubClamd(t, test.reply)
+		s, err := NewScanner(nil, l.Addr().String(), 5*time.Second,
+			ScanPolicyCancel, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range sizes {
+			data := bytes.Repeat([]byte("x"), size)
+			res, err := s.scan("unused", func() (io.ReadCloser, error) {
+				return readCloser{bytes.NewReader(data)}, nil
+			})
+			if test.fails != (err != nil) {
+				t.Errorf("%s, %d bytes: got error %v", test.name, size, err)
+			}
+			if res.infected != test.infected || res.signature != test.signature {
+				t.Errorf("%s, %d bytes: got %+v", test.name, size, res)
+			}
+			if sent := <-got; !bytes.Equal(sent, data) {
+				t.Errorf("%s, %d bytes: clamd got %d bytes", test.name, size,
+					len(sent))
+			}
+		}
+		l.Close()
+	}
+}
+
+func TestScanWithClamdUnreachable(t *testing.T) {
+	l, _ := stubClamd(t, "stream: OK")
+	addr := l.Addr().String()
+	l.Close()
+
+	s, err := NewScanner(nil, addr, time.Second, ScanPolicyCancel, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.scanWithClamd(strings.NewReader("data"))
+	if err == nil {
+		t.Error("scanning without clamd worked")
+	}
+}
+
+func TestScanEmptyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, got := stubClamd(t, "stream: OK")
+	defer l.Close()
+	s, err := NewScanner(nil, l.Addr().String(), 5*time.Second,
+		ScanPolicyCancel, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			files <- r.FormValue("filename")
+			fmt.Fprint(w, "done")
+		}))
+	defer backend.Close()
+	finishURL, _ := url.Parse(backend.URL)
+
+	u := NewUploadToLocalFile(NewLockedUploaderPool(), nil, dir, finishURL,
+		false, "", "tenant", nil, Config{IdleTimeout: time.Minute,
+			HandoverTimeout: 5 * time.Second, Scanner: s})
+	if err = u.SetFileSize(-1); err == nil {
+		t.Error("negative file size was taken")
+	}
+	if err = u.SetFileSize(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// no chunks, the file is here right away
+	if err = <-u.HandFileToApp(); err != nil {
+		t.Fatalf("handover failed: %s", err)
+	}
+	if sent := <-got; len(sent) != 0 {
+		t.Errorf("clamd got %d bytes", len(sent))
+	}
+	filename := <-files
+	if info, err := os.Stat(filename); err != nil || info.Size() != 0 {
+		t.Errorf("app backend got %q: %v", filename, err)
+	}
+}
+
+func TestNewScanner(t *testing.T) {
+	tests := []struct {
+		command       []string
+		clamdAddress  string
+		policy        string
+		quarantineDir string
+		ok            bool
+	}{
+		{[]string{"clamscan"}, "", ScanPolicyCancel, "", true},
+		{nil, "/run/clamd.sock", ScanPolicyFlag, "", true},
+		{nil, "", ScanPolicyCancel, "", false},
+		{[]string{"clamscan"}, "/run/clamd.sock", ScanPolicyCancel, "", false},
+		{[]string{"clamscan"}, "", "delete", "", false},
+		{[]string{"clamscan"}, "", ScanPolicyQuarantine, "", false},
+	}
+	for _, test := range tests {
+		_, err := NewScanner(test.command, test.clamdAddress, 0, test.policy,
+			test.quarantineDir)
+		if test.ok != (err == nil) {
+			t.Errorf("%+v: got error %v", test, err)
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+}
+
+func (readCloser) Close() error {
+	return nil
+}
@@ -20,33 +20,70 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package upload
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/uit-no/incoming/logging"
 )
 
 func initStorageDir(storageDir string) error {
-	// empty directory by removing it (no error if it doesn't exist)
-	err := os.RemoveAll(storageDir)
+	// create directory (no error if it exists)
+	err := os.MkdirAll(storageDir, 0755)
 	if err != nil {
 		return err
 	}
 
-	// create directory
-	err = os.MkdirAll(storageDir, 0755)
+	// empty it, except for partial uploads that can be recovered
+	entries, err := ioutil.ReadDir(storageDir)
 	if err != nil {
 		return err
 	}
+	keep := recoverableFiles(entries)
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		err = os.RemoveAll(path.Join(storageDir, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// changeNotifier lets any number of goroutines wait for the next change of
+// something. Its owner must protect it with a lock.
+type changeNotifier struct {
+	ch chan struct{}
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{ch: make(chan struct{})}
+}
+
+// changed returns a channel that is closed at the next change
+func (n *changeNotifier) changed() <-chan struct{} {
+	return n.ch
+}
+
+// notify tells everybody who waits that there was a change
+func (n *changeNotifier) notify() {
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
 // UploadToLocalFile is an uploader that stores a file in a locally accessible
 // filesystem, and hands over the path to the uploaded file to the web app. In
 // order to be able to use this uploader, both Incoming!! and the web app need
@@ -61,23 +98,80 @@ type UploadToLocalFile struct {
 	lock_state *sync.Mutex
 	state      int
 
-	pool UploaderPool
-	id   string
+	pool        UploaderPool
+	deadLetters *DeadLetterList
+	id          string
+	tenant      string
+	config      Config
+	log         *logging.Logger
 
+	// a socket handler either deals with the whole file, or with a range of
+	// it, in which case there can be several (see BindRangeToSocketHandler)
 	boundToSocketHandler bool
+	boundRanges          []Range
+
+	// a client has paused the upload while other connections were still at
+	// work, so it is paused when the last of them lets go of it
+	pauseWhenUnbound bool
 
 	dir             string
 	path            string
 	nameFromBrowser string
 	fd              *os.File
-	filePos         int64
+	journal         *rangeJournal  // record of what we have
+	crypt           *encryptedFile // nil: file isn't encrypted
+	received        rangeSet       // what we have of the file
+	sha256          string         // hash of the complete file, if known
+	filePos         int64          // how many bytes we have of the file
 	fileSize        int64
+	fileSizeSet     bool
+
+	// what the browser says about the file, if anything
+	mimeTypeFromBrowser     string
+	lastModifiedFromBrowser time.Time
+
+	// when the first and the last byte of the file arrived, and how many
+	// socket handlers have been bound to the upload
+	uploadStartTime time.Time
+	uploadEndTime   time.Time
+	sessions        int
+	startClaimed    bool // see ClaimStart
 
 	signalFinishURL        *url.URL
 	backendSecret          string
+	ticketMetadata         map[string]string // from the app backend
 	removeFileWhenFinished bool
-	chHandoverWait         chan error
-	chHandoverDone         chan struct{}
+	cancelReason           string
+
+	// the batch this file belongs to, if any (see Batch), and where the file
+	// goes within the batch's directory ("": directly into it)
+	batch        *Batch
+	batchIndex   int
+	relativePath string
+
+	// outcome of the handover, once it is over, and channels of everybody
+	// who waits for it (see HandFileToApp)
+	handoverOver        bool
+	handoverResult      error
+	handoverSubscribers []chan error
+	chHandoverDone      chan struct{}
+
+	// fields for the app backend about what we found out about the file
+	// before handover (scan result, results of processing steps)
+	handoverExtra url.Values
+
+	// latest handover status from the app backend. Whenever it changes, a
+	// value is put into the channel (if there is room), which makes the
+	// handover goroutine reset its timeout, and the socket handlers are
+	// notified.
+	handoverStatus          HandoverStatus
+	chHandoverStatusTimeout chan struct{}
+	handoverStatusNotifier  *changeNotifier
+
+	// pause by the app backend or an operator (see PauseByServer)
+	pausedByServer      bool
+	serverPauseReason   string
+	serverPauseNotifier *changeNotifier
 
 	creationTime    time.Time
 	lastActionTime  time.Time
@@ -89,32 +183,71 @@ type UploadToLocalFile struct {
 	chHandleTimeoutClosed chan struct{}
 }
 
-// NewUploadToLocalFile makes a local file uploader.
-func NewUploadToLocalFile(pool UploaderPool, storageDir string,
+// NewUploadToLocalFile makes a local file uploader. Failed handovers go to
+// deadLetters, which may be nil. metadata is passed on to the app backend
+// with the handover (nil: none).
+func NewUploadToLocalFile(pool UploaderPool, deadLetters *DeadLetterList,
+	storageDir string,
 	signalFinishURL *url.URL, removeFileWhenFinished bool,
-	backendSecret string, idleTimeout time.Duration) Uploader {
+	backendSecret string, tenant string, metadata map[string]string,
+	conf Config) Uploader {
+	return newUploadToLocalFile(pool, deadLetters, storageDir, signalFinishURL,
+		removeFileWhenFinished, backendSecret, tenant, metadata, conf, nil, 0,
+		"")
+}
+
+// newUploadToLocalFile makes a local file uploader, which is file number
+// batchIndex of batch if batch is not nil. The uploader gets a new id if id
+// is empty, and the given one otherwise (a recovered upload keeps its id). It
+// returns nil if the given id is in use.
+func newUploadToLocalFile(pool UploaderPool, deadLetters *DeadLetterList,
+	storageDir string,
+	signalFinishURL *url.URL, removeFileWhenFinished bool,
+	backendSecret string, tenant string, metadata map[string]string,
+	conf Config, batch *Batch, batchIndex int, id string) *UploadToLocalFile {
 
 	u := new(UploadToLocalFile)
 	u.lock = new(sync.RWMutex)
 	u.lock_state = new(sync.Mutex)
 	u.pool = pool
+	u.deadLetters = deadLetters
+	u.tenant = tenant
+	u.config = conf
 	u.signalFinishURL = signalFinishURL
 	u.backendSecret = backendSecret
+	u.ticketMetadata = metadata
 	u.removeFileWhenFinished = removeFileWhenFinished
 	u.boundToSocketHandler = false
 	u.dir = storageDir
-	u.chHandoverWait = make(chan error)
 	u.chHandoverDone = make(chan struct{})
+	u.handoverStatus.Progress = -1
+	u.chHandoverStatusTimeout = make(chan struct{}, 1)
+	u.handoverStatusNotifier = newChangeNotifier()
+	u.serverPauseNotifier = newChangeNotifier()
+	u.batch = batch
+	u.batchIndex = batchIndex
 
 	u.creationTime = time.Now()
 	u.lastActionTime = u.creationTime
-	u.idleTimeout = idleTimeout
+	u.idleTimeout = conf.IdleTimeout
 	u.canResetTimeout = true
 	u.chResetTimeout = make(chan time.Duration)
 	u.chHandleTimeoutClosed = make(chan struct{})
-	go u.goHandleTimeout()
 
-	u.id = pool.Put(u)
+	if id == "" {
+		u.id = pool.Put(u)
+	} else if err := pool.PutAs(u, id); err == nil {
+		u.id = id
+	} else {
+		return nil
+	}
+	u.log = logging.With("upload", u.id, "tenant", u.tenant,
+		"state", logging.Lazy(func() interface{} { return StateName(u.GetState()) }))
+	if batch != nil {
+		u.log = u.log.With("batch", batch.id, "batchIndex", batchIndex)
+	}
+	go u.goHandleTimeout()
+	u.log.Info("new upload", "signalFinishURL", signalFinishURL.String())
 
 	return u
 }
@@ -181,6 +314,19 @@ func (u *UploadToLocalFile) resetTimeout(d time.Duration) {
 	}
 }
 
+// timeoutForState returns the timeout for the upload's current state: the
+// paused timeout while the upload is paused, and the idle timeout otherwise.
+// u.lock must be held!
+func (u *UploadToLocalFile) timeoutForState() time.Duration {
+	u.lock_state.Lock()
+	paused := (u.state == StatePaused)
+	u.lock_state.Unlock()
+	if paused || u.pausedByServer {
+		return u.config.PausedTimeout
+	}
+	return u.config.IdleTimeout
+}
+
 // goHandleTimeout is a goroutine that waits for the timeout to happen, and
 // cancels the upload when the timeout happens.  The goroutine starts with
 // u.idleTimeout as timeout.  goHandleTimeout waits for timeout or a call to
@@ -205,7 +351,7 @@ func (u *UploadToLocalFile) goHandleTimeout() {
 			u.lock.Lock()
 			u.canResetTimeout = false
 			u.lock.Unlock()
-			log.Printf("upload %s timed out", u.GetId())
+			u.log.Info("upload timed out")
 			u.Cancel(true, "upload timed out", 5*time.Second)
 			u.CleanUp()
 		case <-u.chHandleTimeoutClosed:
@@ -215,6 +361,34 @@ func (u *UploadToLocalFile) goHandleTimeout() {
 	}
 }
 
+func (u *UploadToLocalFile) GetTenant() string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.tenant
+}
+
+func (u *UploadToLocalFile) GetConfig() Config {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.config
+}
+
+func (u *UploadToLocalFile) SetConfig(conf Config) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.lock_state.Lock()
+	if u.state >= StateHandingOver {
+		u.lock_state.Unlock()
+		return errors.New("too late to change the upload's config")
+	}
+	u.lock_state.Unlock()
+
+	u.config = conf
+	u.resetTimeout(u.timeoutForState())
+	return nil
+}
+
 func (u *UploadToLocalFile) GetId() string {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
@@ -227,12 +401,36 @@ func (u *UploadToLocalFile) GetFilePos() int64 {
 	return u.filePos
 }
 
+func (u *UploadToLocalFile) GetMissingRanges(start, end int64) []Range {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.received.missing(start, end)
+}
+
 func (u *UploadToLocalFile) GetFileSize() int64 {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 	return u.fileSize
 }
 
+func (u *UploadToLocalFile) GetCancelReason() string {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.cancelReason
+}
+
+func (u *UploadToLocalFile) GetMetadata() map[string]string {
+	return u.ticketMetadata // never changes
+}
+
+// addMetadata adds the fields for metadata to v, with prefix in front of
+// their names
+func addMetadata(v url.Values, prefix string, metadata map[string]string) {
+	for key, value := range metadata {
+		v.Set(prefix+MetadataPrefix+key, value)
+	}
+}
+
 func (u *UploadToLocalFile) GetFileName() string {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
@@ -242,20 +440,77 @@ func (u *UploadToLocalFile) GetFileName() string {
 func (u *UploadToLocalFile) SetFileSize(size int64) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
+	if size < 0 {
+		return fmt.Errorf("file size can't be %d", size)
+	}
+	if u.fileSizeSet {
+		// another connection was first
+		if size != u.fileSize {
+			return fmt.Errorf("file size is %d, not %d", u.fileSize, size)
+		}
+		return nil
+	}
 	if u.state != StateInit {
 		return errors.New("too late to call SetFileSize")
 	}
 
+	// an empty file is complete without any chunks, so it won't be made by
+	// ConsumeFileChunkAt
+	if size == 0 {
+		err := u.createEmptyFile()
+		if err != nil {
+			u.log.Error("could not create empty file", "err", err)
+			return errors.New("Could not create file! file system full?")
+		}
+	}
+
 	u.fileSize = size
+	u.fileSizeSet = true
 	u.resetTimeout(u.idleTimeout)
 	return nil
 }
 
+// createEmptyFile makes the (complete) file of an empty upload, where it
+// would go after an upload. u.lock must be held!
+func (u *UploadToLocalFile) createEmptyFile() error {
+	u.path = path.Join(u.dir, u.id+partSuffix)
+	fd, err := os.Create(u.path)
+	if err != nil {
+		u.path = ""
+		return err
+	}
+	if u.config.Encryption != nil {
+		u.crypt, err = newEncryptedFile(u.config.Encryption, 0)
+		if err == nil {
+			err = u.crypt.writeHeader(fd)
+		}
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = u.completeFile()
+	}
+	if err != nil {
+		os.Remove(u.path)
+		u.path = ""
+		u.crypt = nil
+		return err
+	}
+	u.uploadStartTime = time.Now()
+	u.uploadEndTime = u.uploadStartTime
+	return nil
+}
+
 func (u *UploadToLocalFile) SetFileName(name string) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
-	if u.state != StateInit {
-		return errors.New("too late to call SetFileName")
+	if u.state != StateInit || u.nameFromBrowser != "" {
+		// another connection was first
+		if name != u.nameFromBrowser {
+			return errors.New("file name differs from that of the upload")
+		}
+		return nil
 	}
 
 	u.nameFromBrowser = name
@@ -263,15 +518,80 @@ func (u *UploadToLocalFile) SetFileName(name string) error {
 	return nil
 }
 
-func (u *UploadToLocalFile) BindToSocketHandler() error {
+func (u *UploadToLocalFile) SetFileMetadata(mimeType string,
+	lastModified time.Time) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
-	if u.boundToSocketHandler {
-		return errors.New("Bound to some socket handler already!")
+	if u.state != StateInit {
+		return errors.New("too late to call SetFileMetadata")
 	}
+
+	u.mimeTypeFromBrowser = mimeType
+	u.lastModifiedFromBrowser = lastModified
+	return nil
+}
+
+func (u *UploadToLocalFile) BindToSocketHandler() (int, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.boundToSocketHandler || len(u.boundRanges) > 0 {
+		return 0, errors.New("Bound to some socket handler already!")
+	}
+	bind := u.bindKind()
 	u.boundToSocketHandler = true
+	u.pauseWhenUnbound = false
+	u.sessions++
 	u.resetTimeout(u.idleTimeout)
-	return nil
+	return bind, nil
+}
+
+func (u *UploadToLocalFile) BindRangeToSocketHandler(start, end int64) (int,
+	error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.boundToSocketHandler {
+		return 0, errors.New("Bound to some socket handler already!")
+	}
+	if uint(len(u.boundRanges)) >= u.config.MaxConnections {
+		return 0, fmt.Errorf("upload can't have more than %d connections",
+			u.config.MaxConnections)
+	}
+	for _, r := range u.boundRanges {
+		if r.Start < end && start < r.End {
+			return 0, errors.New("range overlaps with that of another socket handler")
+		}
+	}
+	bind := u.bindKind()
+	u.boundRanges = append(u.boundRanges, Range{start, end})
+	u.pauseWhenUnbound = false
+	u.sessions++
+	u.resetTimeout(u.idleTimeout)
+	return bind, nil
+}
+
+// bindKind tells how a new connection relates to the ones the upload has
+// (and had). u.lock must be held!
+func (u *UploadToLocalFile) bindKind() int {
+	switch {
+	case u.boundToSocketHandler || len(u.boundRanges) > 0:
+		return BindParallel
+	case u.sessions > 0:
+		return BindAgain
+	}
+	return BindFirst
+}
+
+func (u *UploadToLocalFile) UnbindRangeFromSocketHandler(start, end int64) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for i, r := range u.boundRanges {
+		if r.Start == start && r.End == end {
+			u.boundRanges = append(u.boundRanges[:i], u.boundRanges[i+1:]...)
+			u.unbound()
+			return nil
+		}
+	}
+	return errors.New("range not bound to any socket handler")
 }
 
 func (u *UploadToLocalFile) UnbindFromSocketHandler() error {
@@ -281,39 +601,126 @@ func (u *UploadToLocalFile) UnbindFromSocketHandler() error {
 		return errors.New("not bound to any socket handler")
 	}
 	u.boundToSocketHandler = false
-	u.resetTimeout(u.idleTimeout)
+	u.unbound()
 	return nil
 }
 
+// unbound is called when a socket handler has let go of the upload. If a
+// client paused the upload while other connections were still at work, and
+// this was the last of them, the upload is paused now. u.lock must be held!
+func (u *UploadToLocalFile) unbound() {
+	if u.pauseWhenUnbound && !u.boundToSocketHandler &&
+		len(u.boundRanges) == 0 {
+		u.pauseWhenUnbound = false
+		u.lock_state.Lock()
+		pause := u.state == StateUploading && u.filePos < u.fileSize
+		if pause {
+			u.state = StatePaused
+		}
+		u.lock_state.Unlock()
+		if pause {
+			u.closeFile()
+		}
+	}
+	u.resetTimeout(u.timeoutForState())
+}
+
 func (u *UploadToLocalFile) ConsumeFileChunk(chunk []byte) error {
+	u.lock.RLock()
+	pos := u.fileSize
+	if missing := u.received.missing(0, u.fileSize); len(missing) > 0 {
+		pos = missing[0].Start
+	}
+	u.lock.RUnlock()
+	return u.ConsumeFileChunkAt(pos, chunk)
+}
+
+func (u *UploadToLocalFile) ConsumeFileChunkAt(offset int64, chunk []byte) error {
 	u.lock.Lock()
 	defer u.lock.Unlock()
-	defer u.resetTimeout(u.idleTimeout)
+	defer func() { u.resetTimeout(u.timeoutForState()) }()
+
+	if u.pausedByServer {
+		return errors.New("upload is paused by the server")
+	}
 
-	// quite a bit of "state business" follows.
+	// quite a bit of "state business" follows. We must not log while we hold
+	// lock_state (the logger asks for the state), so we only remember what
+	// to log.
 	u.lock_state.Lock()
+	var journalMismatch bool
+	var written int64
 
 	// make new file if we have to
 	if u.state == StateInit {
-		u.path = path.Join(u.dir, fmt.Sprintf("%s.part", u.id))
+		u.path = path.Join(u.dir, u.id+partSuffix)
 		//log.Printf("creating file %s", u.path)
 		fd, err := os.Create(u.path)
 		if err != nil {
 			u.lock_state.Unlock()
 			return errors.New("Could not create file! file system full?")
 		}
+		journal, err := createRangeJournal(u.journalPath())
+		if err != nil {
+			fd.Close()
+			u.lock_state.Unlock()
+			return errors.New("Could not create journal! file system full?")
+		}
+		if u.config.Encryption != nil {
+			u.crypt, err = newEncryptedFile(u.config.Encryption, u.fileSize)
+			if err == nil {
+				err = u.crypt.writeHeader(fd)
+			}
+			if err != nil {
+				fd.Close()
+				journal.remove()
+				u.lock_state.Unlock()
+				u.log.Error("could not set up encryption", "err", err)
+				return errors.New("Could not set up encryption!")
+			}
+		}
 		u.fd = fd
+		u.journal = journal
+		u.uploadStartTime = time.Now()
+
+		// an upload of its own can be recovered after a crash, with what
+		// its ticket said (see RecoverUploads)
+		if u.batch == nil {
+			err = u.writeRecord()
+			if err != nil {
+				u.lock_state.Unlock()
+				u.log.Error("could not write upload record", "err", err)
+				return errors.New("Could not write upload record! file system full?")
+			}
+		}
 	}
 
-	// if we are resuming an upload, open the file we already have
+	// if we are resuming an upload, open the file we already have, and take
+	// what we have of it from its journal
 	if u.state == StatePaused {
 		fd, err := os.OpenFile(u.path, os.O_RDWR, 0666)
 		if err != nil {
 			u.lock_state.Unlock()
 			return errors.New("Could not re-open file! Is it gone?")
 		}
+		journal, recorded, err := openRangeJournal(u.journalPath())
+		if err != nil {
+			fd.Close()
+			u.lock_state.Unlock()
+			return errors.New("Could not re-open journal! Is it gone?")
+		}
+		// (segments of an encrypted file that we had only some bytes of
+		// were lost when the file was closed)
+		written = u.filePos
+		if u.crypt != nil {
+			written = u.crypt.written.size()
+			u.crypt.reset(recorded)
+		}
+		journalMismatch = recorded.size() != written
 		u.fd = fd
-		_, _ = u.fd.Seek(0, os.SEEK_END)
+		u.journal = journal
+		u.received = recorded
+		u.filePos = recorded.size()
 	}
 
 	// make sure we are in a legal state to proceed (i.e., not in any of the "we're
@@ -330,36 +737,164 @@ func (u *UploadToLocalFile) ConsumeFileChunk(chunk []byte) error {
 
 	// "state business" ends.
 	u.lock_state.Unlock()
+	if journalMismatch {
+		u.log.Warn("journal doesn't match what we have of the file, "+
+			"going with the journal", "written", written,
+			"recorded", u.received.size())
+	}
 
 	// assert that fileSize will not be exceeded
-	if u.filePos+int64(len(chunk)) > u.fileSize {
+	if offset < 0 || offset+int64(len(chunk)) > u.fileSize {
 		return errors.New("File would get larger than declared")
 	}
+	if u.fd == nil {
+		return errors.New("file is complete already")
+	}
 
-	// write! and if there was a problem, undo the write
-	bytesWritten, err := u.fd.Write(chunk)
-	if err != nil {
-		u.fd.Truncate(u.filePos)
-		_, _ = u.fd.Seek(0, os.SEEK_END)
-		return err
+	// write! If there was a problem, we don't count the range as received,
+	// so it will be sent again. An encrypted file gets whole segments
+	// written once we have all of their bytes.
+	if u.crypt != nil {
+		written, err := u.crypt.writeAt(u.fd, chunk, offset)
+		for _, r := range written {
+			u.journal.add(r.Start, r.End)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := u.fd.WriteAt(chunk, offset)
+		if err != nil {
+			return err
+		}
+		u.journal.add(offset, offset+int64(len(chunk)))
 	}
-	u.filePos += int64(bytesWritten)
+	u.received = u.received.add(offset, offset+int64(len(chunk)))
+	u.filePos = u.received.size()
 
-	// if file is complete, close and rename it
+	// if file is complete, close and rename it (and move it to its relative
+	// path, if it has one). We don't need its journal any more.
 	if u.filePos == u.fileSize {
+		u.uploadEndTime = time.Now()
 		u.fd.Close()
 		u.fd = nil
-		newName := u.path[:len(u.path)-5]
-		err = os.Rename(u.path, newName)
+		u.journal.remove()
+		u.journal = nil
+		return u.completeFile()
+	}
+
+	// record what we have every now and then
+	err := u.journal.flush(u.fd, false)
+	if err != nil {
+		u.log.Error("could not record received ranges", "err", err)
+		return errors.New("Could not record received ranges! file system full?")
+	}
+
+	return nil
+}
+
+// completeFile renames the partial file, which must be closed and complete,
+// to its final name (or moves it to its relative path, if it has one), and
+// removes the upload's record. The caller must hold the lock.
+func (u *UploadToLocalFile) completeFile() error {
+	newName := strings.TrimSuffix(u.path, partSuffix)
+	if u.relativePath != "" {
+		newName = path.Join(u.dir, u.relativePath)
+		err := os.MkdirAll(path.Dir(newName), 0755)
 		if err != nil {
 			return err
 		}
-		u.path = newName
 	}
-
+	err := os.Rename(u.path, newName)
+	if err != nil {
+		return err
+	}
+	os.Remove(u.recordPath())
+	u.path = newName
 	return nil
 }
 
+// journalPath returns where the journal of the (partial) file is
+func (u *UploadToLocalFile) journalPath() string {
+	return u.path + journalSuffix
+}
+
+// closeFile records what we have of the file, and closes the file and its
+// journal if they are open. Segments of an encrypted file that we have only
+// some bytes of are lost, so the browser is asked for them again. The caller
+// must hold the lock.
+func (u *UploadToLocalFile) closeFile() {
+	if u.fd == nil {
+		return
+	}
+	err := u.journal.flush(u.fd, true)
+	if err != nil {
+		u.log.Error("could not record received ranges", "err", err)
+	}
+	u.journal.close()
+	u.journal = nil
+	u.fd.Close()
+	u.fd = nil
+	if u.crypt != nil {
+		u.crypt.reset(u.crypt.written)
+		u.received = append(rangeSet(nil), u.crypt.written...)
+		u.filePos = u.received.size()
+	}
+}
+
+func (u *UploadToLocalFile) ClaimStart() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.startClaimed || u.uploadStartTime.IsZero() {
+		return false
+	}
+	u.startClaimed = true
+	return true
+}
+
+func (u *UploadToLocalFile) TakeFromDedupStore(hash string) (found bool,
+	err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.config.Dedup == nil {
+		return false, nil
+	}
+	u.lock_state.Lock()
+	state := u.state
+	u.lock_state.Unlock()
+	if state != StateInit || u.pausedByServer {
+		return false, errors.New("upload is in no state for this")
+	}
+
+	// the file goes where it would go after an upload
+	dst := path.Join(u.dir, u.id)
+	if u.relativePath != "" {
+		dst = path.Join(u.dir, u.relativePath)
+		err = os.MkdirAll(path.Dir(dst), 0755)
+		if err != nil {
+			return false, err
+		}
+	}
+	found, err = u.config.Dedup.Place(hash, u.fileSize, dst)
+	if !found || err != nil {
+		return
+	}
+
+	u.path = dst
+	u.received = rangeSet{{0, u.fileSize}}
+	u.filePos = u.fileSize
+	u.uploadStartTime = time.Now()
+	u.uploadEndTime = u.uploadStartTime
+	u.sha256 = hash
+	u.lock_state.Lock()
+	u.state = StateUploading
+	u.lock_state.Unlock()
+	u.resetTimeout(u.idleTimeout)
+	u.log.Info("took file from dedup store", "sha256", hash)
+	return true, nil
+}
+
 func (u *UploadToLocalFile) Pause() (err error) {
 	u.lock.Lock()
 	defer u.lock.Unlock()
@@ -368,43 +903,127 @@ func (u *UploadToLocalFile) Pause() (err error) {
 	u.lock_state.Lock()
 	if u.state != StateUploading && u.state != StatePaused {
 		err = errors.New("can't pause now")
-	} else {
-		u.state = StatePaused
 	}
 	u.lock_state.Unlock()
 	if err != nil {
 		return
 	}
 
+	// other connections of a parallel upload may still be writing (the
+	// pausing one is bound until it returns). Closing the file would lose
+	// what they have of encrypted segments, so the upload is paused when the
+	// last of them is gone.
+	if len(u.boundRanges) > 1 {
+		u.pauseWhenUnbound = true
+		return nil
+	}
+
 	// close the file
-	if u.fd != nil {
-		u.fd.Close()
-		u.fd = nil
+	u.lock_state.Lock()
+	u.state = StatePaused
+	u.lock_state.Unlock()
+	u.closeFile()
+
+	u.resetTimeout(u.timeoutForState())
+	return nil
+}
+
+func (u *UploadToLocalFile) PauseByServer(reason string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	// assert that we are in a legal state, set state to paused (unless we
+	// have nothing to pause yet)
+	u.lock_state.Lock()
+	if u.state > StatePaused {
+		u.lock_state.Unlock()
+		return errors.New("can't pause now")
+	}
+	if u.state != StateInit {
+		u.state = StatePaused
 	}
+	u.lock_state.Unlock()
 
-	u.resetTimeout(u.idleTimeout)
+	// close the file
+	u.closeFile()
+
+	u.pausedByServer = true
+	u.serverPauseReason = reason
+	u.serverPauseNotifier.notify()
+	u.resetTimeout(u.timeoutForState())
+	u.log.Info("upload paused by server", "reason", reason)
+	return nil
+}
+
+func (u *UploadToLocalFile) ResumeByServer() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if !u.pausedByServer {
+		return errors.New("upload is not paused by the server")
+	}
+	u.pausedByServer = false
+	u.serverPauseReason = ""
+	u.serverPauseNotifier.notify()
+	u.resetTimeout(u.timeoutForState())
+	u.log.Info("upload resumed by server")
 	return nil
 }
 
-func (u *UploadToLocalFile) HandFileToApp(reqTimeout time.Duration,
-	respTimeout time.Duration) (ch_ret chan error) {
+func (u *UploadToLocalFile) GetServerPause() (paused bool, reason string) {
 	u.lock.RLock()
-	ch_ret = u.chHandoverWait
-	u.lock.RUnlock()
+	defer u.lock.RUnlock()
+	return u.pausedByServer, u.serverPauseReason
+}
+
+func (u *UploadToLocalFile) ServerPauseChanged() <-chan struct{} {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.serverPauseNotifier.changed()
+}
+
+func (u *UploadToLocalFile) HandFileToApp() (ch_ret chan error) {
+	// each caller gets its own channel, with room for the outcome so that
+	// nobody has to listen
+	ch_ret = make(chan error, 1)
+
+	u.lock.Lock()
+	reqTimeout := u.config.HandoverTimeout
+	respTimeout := u.config.HandoverConfirmTimeout
+	retryWindow := u.config.HandoverRetryWindow
+	dedup := u.config.Dedup
+	knownHash := u.sha256
+	encryption := u.config.Encryption
+	crypt := u.crypt
+	scanner := u.config.Scanner
+	pipeline := u.config.Processing
 
 	// figure out whether we have to do anything (we might have been called
 	// before or we might be in a wrong state)
 	u.lock_state.Lock()
-	run := (u.state < StateHandingOver)
+	state := u.state
+	run := (state < StateHandingOver)
 	if run {
 		u.state = StateHandingOver
 	}
 	u.lock_state.Unlock()
 
+	switch {
+	case run || (state == StateHandingOver && !u.handoverOver):
+		// the goroutine below (ours or one that is running already) will
+		// tell us
+		u.handoverSubscribers = append(u.handoverSubscribers, ch_ret)
+	case u.handoverOver:
+		ch_ret <- u.handoverResult
+		close(ch_ret)
+	default:
+		// cancelled before there was anything to hand over
+		ch_ret <- fmt.Errorf("upload was cancelled: %s", u.cancelReason)
+		close(ch_ret)
+	}
+	u.lock.Unlock()
+
 	if !run {
-		// if the function was called while the goroutine below is running, all
-		// is fine because ch_ret will be closed when handover is done or
-		// has failed
 		return
 	}
 
@@ -412,93 +1031,431 @@ func (u *UploadToLocalFile) HandFileToApp(reqTimeout time.Duration,
 		htclient := new(http.Client)
 		htclient.Timeout = reqTimeout
 
-		// signal app backend that we are done
-		v := url.Values{}
-		v.Set("id", u.id)
-		v.Set("filename", u.path)
-		v.Set("filenameFromBrowser", u.nameFromBrowser)
-		v.Set("backendSecret", u.backendSecret)
-		v.Set("cancelled", "no")
-		v.Set("cancelReason", "")
+		// the idle timeout must not hit while we prepare the file, retry, or
+		// wait for the app backend, so we switch it off until handover is
+		// over
 		u.lock.Lock()
-		u.resetTimeout(u.idleTimeout)
-		u.lock.Unlock()
-		resp, err := htclient.PostForm(u.signalFinishURL.String(), v) // this takes time
-		u.lock.Lock()
-		u.resetTimeout(u.idleTimeout)
+		idleTimeout := u.idleTimeout
+		u.resetTimeout(0)
 		u.lock.Unlock()
 
-		// set error if http went through but we got a bad http status back
-		if err == nil && resp.StatusCode != 200 {
-			//log.Printf("Got bad http status on handover: %s", resp.Status)
-			err = fmt.Errorf("Got bad http status on handover: %s", resp.Status)
+		// decrypt the file if the app backend wants it that way
+		var err error
+		if crypt != nil && !encryption.handOverKey {
+			err = encryption.decryptFile(u.path, u.path)
+			if err != nil {
+				u.log.Error("couldn't decrypt file", "err", err)
+				err = fmt.Errorf("couldn't decrypt file: %s", err)
+			}
 		}
 
-		// read (first 4 bytes of) response body if we can
-		respBody := []byte(nil)
+		// tell the app backend what we know about the file
 		if err == nil {
-			if resp.ContentLength > -1 {
-				respBody = make([]byte, resp.ContentLength)
-				resp.Body.Read(respBody)
-				resp.Body.Close()
+			u.addHandoverExtra(u.metadata(u.openPlain(encryption,
+				crypt != nil && encryption.handOverKey)))
+		}
+
+		// scan the file before anybody gets it. Files that are infected (or
+		// can't be scanned) might not be handed over at all.
+		if err == nil && scanner != nil {
+			extra, rejectReason := u.scanFile(scanner, encryption, crypt != nil &&
+				encryption.handOverKey)
+			u.addHandoverExtra(extra)
+			if rejectReason != "" {
+				quarantineDir := ""
+				if scanner.policy == ScanPolicyQuarantine {
+					quarantineDir = scanner.quarantineDir
+				}
+				u.reject(rejectReason, quarantineDir, reqTimeout, idleTimeout)
+				return
 			}
 		}
-		var respStr string
-		if err == nil {
-			respStr = string(respBody[0:4])
+
+		// run the processing steps. If one of them fails (and it matters),
+		// the file isn't handed over.
+		if err == nil && pipeline != nil {
+			u.lock.RLock()
+			size := u.fileSize
+			u.lock.RUnlock()
+			extra, err := pipeline.run(u.path, size, u.openPlain(encryption,
+				crypt != nil && encryption.handOverKey), u.log)
+			u.addHandoverExtra(extra)
+			if err != nil {
+				u.reject(err.Error(), "", reqTimeout, idleTimeout)
+				return
+			}
 		}
-		//log.Printf("Got response from app backend: %s", respStr)
 
-		// response is "done"? yay, we'll be done. response is "wait"? we'll wait...
-		wait := false
-		if err == nil {
-			if respStr == "wait" {
-				wait = true
-			} else if respStr == "done" {
-				wait = false
+		// keep the file for later uploads of the same content. The app
+		// backend might move it away as soon as it knows about it, so this
+		// has to happen first.
+		if err == nil && dedup != nil && knownHash == "" {
+			hash, err := dedup.Retain(u.path)
+			if err != nil {
+				u.log.Warn("couldn't keep file in dedup store", "err", err)
 			} else {
-				err = errors.New("don't understand reply from app backend")
+				u.log.Debug("file is in dedup store", "sha256", hash)
+				u.lock.Lock()
+				u.sha256 = hash
+				u.lock.Unlock()
 			}
 		}
 
+		// signal app backend that we are done
+		v := url.Values{}
+		v.Set("id", u.id)
+		v.Set("filename", u.path)
+		v.Set("filenameFromBrowser", u.nameFromBrowser)
+		v.Set("backendSecret", u.backendSecret)
+		v.Set("cancelled", "no")
+		v.Set("cancelReason", "")
+		addMetadata(v, "", u.ticketMetadata)
+		if u.batch != nil {
+			v.Set("batchId", u.batch.id)
+			v.Set("batchIndex", strconv.Itoa(u.batchIndex))
+			v.Set("relativePath", u.relativePath)
+		}
+		if crypt != nil && encryption.handOverKey {
+			v.Set("encryption", EncryptionFormat)
+			v.Set("encryptionKey", base64.StdEncoding.EncodeToString(crypt.wrappedKey))
+		}
+		u.lock.RLock()
+		for key, values := range u.handoverExtra {
+			v[key] = values
+		}
+		u.lock.RUnlock()
+
+		// files of a batch might not be handed over on their own, in which
+		// case they are done right away
+		reply := &handoverReply{Action: handoverActionDone}
+		var attempts int
+		if err == nil && u.handsOverOnItsOwn() {
+			var resp *http.Response
+			resp, attempts, err = postHandover(htclient, u.signalFinishURL.String(),
+				v, retryWindow, u.log) // this takes time
+
+			// response is "done"? yay, we'll be done. response is "wait"? we'll wait...
+			if err == nil {
+				reply, err = readHandoverReply(resp)
+			}
+		}
+
+		// rename the file if the app backend wants us to
+		if err == nil && reply.Filename != "" {
+			err = u.rename(reply.Filename)
+		}
+
 		// wait if we have to
-		if wait {
-			log.Printf("wait for app backend")
-			select {
-			case <-u.chHandoverDone:
-				u.lock.Lock()
-				u.resetTimeout(u.idleTimeout)
-				u.lock.Unlock()
-			case <-time.After(respTimeout):
-				err = errors.New("Timed out waiting for app backend to retrieve the file")
+		if err == nil && reply.Action == handoverActionWait {
+			timeout := reply.confirmTimeout(respTimeout)
+			u.log.Info("wait for app backend", "timeout", timeout.String())
+			timer := time.NewTimer(timeout)
+			for waiting := true; waiting; {
+				select {
+				case <-u.chHandoverDone:
+					waiting = false
+				case <-u.chHandoverStatusTimeout:
+					// backend is still busy with the file, give it more time
+					timer.Reset(timeout)
+				case <-timer.C:
+					err = errors.New("Timed out waiting for app backend to retrieve the file")
+					waiting = false
+				}
 			}
-			log.Printf("wait done")
+			timer.Stop()
+			u.log.Info("wait done", "err", err)
 		}
+		u.lock.Lock()
+		u.resetTimeout(idleTimeout)
+		u.lock.Unlock()
 
-		// update state
+		// update state, and tell everybody who waits for the outcome
+		u.lock.Lock()
 		u.lock_state.Lock()
 		if err == nil {
 			u.state = StateFinished
-			u.lock_state.Unlock()
 		} else {
 			u.state = StateCancelled
-			u.lock_state.Unlock()
-			u.lock.RLock()
-			log.Printf("upload %s handover failed: %v", u.id, err)
-			u.lock.RUnlock()
-			u.Cancel(false, "handover failed", 0)
+			u.cancelReason = fmt.Sprintf("handover failed: %s", err)
+		}
+		u.lock_state.Unlock()
+		u.handoverOver = true
+		u.handoverResult = err
+		for _, ch := range u.handoverSubscribers {
+			ch <- err
+			close(ch)
 		}
+		u.handoverSubscribers = nil
+		u.lock.Unlock()
 
-		// try to send error over return channel, then close it
-		select {
-		case ch_ret <- err:
-		case <-time.After(u.idleTimeout):
+		// If handover failed, we keep the file and leave a dead letter, so
+		// that an admin can replay the handover later. The file might have
+		// been renamed since the request was made, and a file of a batch
+		// must not go away with the batch's directory.
+		if err != nil {
+			u.log.Warn("handover failed", "err", err, "attempts", attempts)
+			if u.deadLetters != nil {
+				if u.batch != nil {
+					u.moveOutOfBatch()
+				}
+				u.lock.RLock()
+				filePath := u.path
+				u.lock.RUnlock()
+				v.Set("filename", filePath)
+				u.deadLetters.Add(&DeadLetter{
+					Id:                     u.id,
+					Tenant:                 u.tenant,
+					SignalFinishURL:        u.signalFinishURL.String(),
+					FileName:               filePath,
+					FileNameFromBrowser:    u.nameFromBrowser,
+					Error:                  err.Error(),
+					Attempts:               attempts,
+					FailedAt:               time.Now(),
+					form:                   v,
+					removeFileWhenFinished: u.removeFileWhenFinished,
+				})
+			}
+		}
+		if u.batch != nil {
+			u.batch.fileDone(u.batchIndex)
 		}
-		close(ch_ret)
 	}()
 	return
 }
 
+// handsOverOnItsOwn returns false for files of a batch that are only handed
+// over together with the batch.
+func (u *UploadToLocalFile) handsOverOnItsOwn() bool {
+	return u.batch == nil || u.batch.fileSignalFinishURL != nil
+}
+
+// batchFileInfo is what a batch needs to know about one of its files
+type batchFileInfo struct {
+	id              string
+	path            string
+	nameFromBrowser string
+	relativePath    string
+	size            int64
+	finished        bool // false: cancelled
+	cancelReason    string
+	encryptionKey   string // wrapped data key, if handed over encrypted
+	extra           url.Values
+}
+
+func (u *UploadToLocalFile) batchFileInfo() (info batchFileInfo) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	info.id = u.id
+	info.path = u.path
+	info.nameFromBrowser = u.nameFromBrowser
+	info.relativePath = u.relativePath
+	info.size = u.fileSize
+	info.finished = u.handoverOver && u.handoverResult == nil
+	info.cancelReason = u.cancelReason
+	if u.crypt != nil && u.config.Encryption.handOverKey {
+		info.encryptionKey = base64.StdEncoding.EncodeToString(u.crypt.wrappedKey)
+	}
+	info.extra = u.handoverExtra
+	return
+}
+
+// scanFile scans the file with scanner. It returns the fields that tell the
+// app backend the result, and a reason if the file must not be handed over.
+// If the file is encrypted, scanner gets its plain content.
+func (u *UploadToLocalFile) scanFile(scanner *Scanner, encryption *Encryption,
+	encrypted bool) (fields url.Values, rejectReason string) {
+	u.setScanning(true)
+	res, err := scanner.scan(u.path, u.openPlain(encryption, encrypted))
+	u.setScanning(false)
+
+	fields = url.Values{}
+	switch {
+	case err != nil:
+		u.log.Error("couldn't scan file", "err", err)
+		fields.Set("scanResult", scanResultError)
+		fields.Set("scanError", err.Error())
+		if scanner.policy != ScanPolicyFlag {
+			rejectReason = fmt.Sprintf("couldn't scan file: %s", err)
+		}
+	case res.infected:
+		u.log.Warn("file is infected", "signature", res.signature,
+			"policy", scanner.policy)
+		fields.Set("scanResult", scanResultInfected)
+		fields.Set("scanSignature", res.signature)
+		if scanner.policy != ScanPolicyFlag {
+			rejectReason = fmt.Sprintf("file is infected: %s", res.signature)
+		}
+	default:
+		u.log.Debug("file is clean")
+		fields.Set("scanResult", scanResultClean)
+	}
+	return
+}
+
+// addHandoverExtra adds fields to those that the app backend gets with the
+// handover
+func (u *UploadToLocalFile) addHandoverExtra(fields url.Values) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.handoverExtra == nil {
+		u.handoverExtra = url.Values{}
+	}
+	for key, values := range fields {
+		u.handoverExtra[key] = values
+	}
+}
+
+// metadata returns the fields that tell the app backend about the file and
+// its upload. open gives the file's plain content, for sniffing its MIME
+// type.
+func (u *UploadToLocalFile) metadata(
+	open func() (io.ReadCloser, error)) url.Values {
+	u.lock.RLock()
+	size := u.received.size()
+	v := url.Values{}
+	v.Set("size", strconv.FormatInt(size, 10))
+	v.Set("mimeTypeFromBrowser", u.mimeTypeFromBrowser)
+	v.Set("lastModifiedFromBrowser", formatTime(u.lastModifiedFromBrowser))
+	v.Set("uploadStarted", formatTime(u.uploadStartTime))
+	v.Set("uploadFinished", formatTime(u.uploadEndTime))
+	v.Set("sessions", strconv.Itoa(u.sessions))
+	duration := u.uploadEndTime.Sub(u.uploadStartTime).Seconds()
+	u.lock.RUnlock()
+
+	// (files taken from the dedup store didn't take any time)
+	if duration > 0 {
+		v.Set("throughputBytesPerS",
+			strconv.FormatInt(int64(float64(size)/duration), 10))
+	} else {
+		v.Set("throughputBytesPerS", "")
+	}
+
+	// http.DetectContentType looks at 512 bytes at most
+	v.Set("mimeType", "")
+	if r, err := open(); err == nil {
+		head, err := ioutil.ReadAll(io.LimitReader(r, 512))
+		r.Close()
+		if err == nil {
+			v.Set("mimeType", http.DetectContentType(head))
+		} else {
+			u.log.Warn("couldn't sniff MIME type", "err", err)
+		}
+	}
+	return v
+}
+
+// formatTime formats t for the app backend, or returns "" if t is zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// openPlain returns a function that opens the file for reading its plain
+// content, decrypting it on the fly if it is encrypted.
+func (u *UploadToLocalFile) openPlain(encryption *Encryption,
+	encrypted bool) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		if encrypted {
+			return encryption.openDecrypted(u.path), nil
+		}
+		fd, err := os.Open(u.path)
+		return fd, err
+	}
+}
+
+// setScanning tells the socket handlers whether we are scanning the file
+func (u *UploadToLocalFile) setScanning(scanning bool) {
+	u.lock.Lock()
+	u.handoverStatus.Scanning = scanning
+	u.handoverStatusNotifier.notify()
+	u.lock.Unlock()
+}
+
+// reject cancels the upload of a file that must not be handed over because
+// of what scanning or processing found. The file is moved to quarantineDir
+// (if it isn't "") or removed, and the app backend is told that the upload
+// was cancelled.
+func (u *UploadToLocalFile) reject(reason string, quarantineDir string,
+	reqTimeout time.Duration, idleTimeout time.Duration) {
+	remove := true
+	if quarantineDir != "" {
+		dst := path.Join(quarantineDir, u.id)
+		err := linkOrCopy(u.path, dst)
+		if err != nil {
+			// better leave it where it is than lose it
+			u.log.Error("couldn't quarantine file", "err", err)
+			remove = false
+		} else {
+			u.log.Info("file quarantined", "path", dst)
+		}
+	}
+	if remove {
+		os.Remove(u.path)
+	}
+
+	err := &RejectedError{Reason: reason}
+	u.lock.Lock()
+	u.lock_state.Lock()
+	u.state = StateCancelled
+	u.lock_state.Unlock()
+	u.cancelReason = reason
+	u.handoverOver = true
+	u.handoverResult = err
+	for _, ch := range u.handoverSubscribers {
+		ch <- err
+		close(ch)
+	}
+	u.handoverSubscribers = nil
+	extra := u.handoverExtra
+	u.resetTimeout(idleTimeout)
+	u.lock.Unlock()
+	u.log.Info("upload cancelled", "reason", reason)
+
+	if u.handsOverOnItsOwn() {
+		if err := u.postCancelled(reason, extra, reqTimeout); err != nil {
+			u.log.Warn("couldn't tell app backend about cancelled upload",
+				"err", err)
+		}
+	}
+	if u.batch != nil {
+		u.batch.fileDone(u.batchIndex)
+	}
+}
+
+// rename renames the uploaded file within its directory. name must be a
+// plain file name, and there must not be a file with that name already.
+func (u *UploadToLocalFile) rename(name string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	newPath := path.Join(path.Dir(u.path), name)
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("can't rename file to %q, file exists", name)
+	}
+	if err := os.Rename(u.path, newPath); err != nil {
+		return fmt.Errorf("can't rename file to %q: %s", name, err)
+	}
+	u.log.Info("renamed file as requested by app backend", "path", newPath)
+	u.path = newPath
+	return nil
+}
+
+// moveOutOfBatch moves the file of a batch out of the batch's directory, to
+// where a file of its own would be, so that it stays when the batch is
+// cleaned up.
+func (u *UploadToLocalFile) moveOutOfBatch() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	newPath := path.Join(path.Dir(u.batch.dir), u.id)
+	if err := os.Rename(u.path, newPath); err != nil {
+		u.log.Error("can't move file out of batch directory", "path", u.path,
+			"err", err)
+		return
+	}
+	u.path = newPath
+}
+
 // called by web app backend to signal that it is done retrieving
 // the uploaded file.
 func (u *UploadToLocalFile) HandoverDone() error {
@@ -517,6 +1474,39 @@ func (u *UploadToLocalFile) HandoverDone() error {
 	}
 }
 
+func (u *UploadToLocalFile) SetHandoverStatus(status HandoverStatus) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.lock_state.Lock()
+	if u.state != StateHandingOver {
+		u.lock_state.Unlock()
+		return errors.New("uploader is not in 'handing over' state")
+	}
+	u.lock_state.Unlock()
+
+	status.Scanning = u.handoverStatus.Scanning // that's up to us
+	u.handoverStatus = status
+	select {
+	case u.chHandoverStatusTimeout <- struct{}{}:
+	default: // there is a notification already
+	}
+	u.handoverStatusNotifier.notify()
+	return nil
+}
+
+func (u *UploadToLocalFile) GetHandoverStatus() HandoverStatus {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.handoverStatus
+}
+
+func (u *UploadToLocalFile) HandoverStatusChanged() <-chan struct{} {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.handoverStatusNotifier.changed()
+}
+
 func (u *UploadToLocalFile) Cancel(tellAppBackend bool, reason string,
 	reqTimeout time.Duration) error {
 	u.lock.Lock()
@@ -535,42 +1525,65 @@ func (u *UploadToLocalFile) Cancel(tellAppBackend bool, reason string,
 		u.lock.Unlock()
 		return errors.New("too late to cancel")
 	}
+	if !alreadyCancelled {
+		u.cancelReason = reason
+		u.log.Info("upload cancelled", "reason", reason)
+		if u.batch != nil {
+			// the batch must not be told while we hold the lock
+			defer u.batch.fileDone(u.batchIndex)
+		}
+	}
 
 	// close file if it is open
-	if u.fd != nil {
-		u.fd.Close()
-		u.fd = nil
-	}
-	// delete file if we already have one
+	u.closeFile()
+	// delete file, its journal and its record if we already have them
 	if u.path != "" {
 		os.Remove(u.path)
+		os.Remove(u.journalPath())
+		os.Remove(u.recordPath())
 	}
 
 	u.resetTimeout(u.idleTimeout)
 
-	// return nil if we don't have to tell web app backend
-	if alreadyCancelled || !tellAppBackend {
+	// return nil if we don't have to tell web app backend (files of a batch
+	// that are not handed over on their own are reported with the batch)
+	if alreadyCancelled || !tellAppBackend || !u.handsOverOnItsOwn() {
 		u.lock.Unlock()
 		return nil
 	}
 
 	// tell app backend that we have cancelled. We don't need to hold the lock
 	// for this.
-	backendSecret := u.backendSecret
-	signalFinishURL := u.signalFinishURL
-	id := u.id
 	u.lock.Unlock()
+	err := u.postCancelled(reason, nil, reqTimeout)
 
-	htclient := new(http.Client)
-	htclient.Timeout = reqTimeout
+	u.lock.Lock()
+	u.resetTimeout(u.idleTimeout)
+	u.lock.Unlock()
+	return err
+}
 
+// postCancelled tells the app backend that the upload was cancelled, with
+// extra fields if there are any. The caller must not hold the lock.
+func (u *UploadToLocalFile) postCancelled(reason string, extra url.Values,
+	reqTimeout time.Duration) (err error) {
+	u.lock.RLock()
+	signalFinishURL := u.signalFinishURL
 	v := url.Values{}
-	v.Set("id", id)
+	v.Set("id", u.id)
 	v.Set("filename", "")
 	v.Set("filenameFromBrowser", u.nameFromBrowser)
-	v.Set("backendSecret", backendSecret)
+	v.Set("backendSecret", u.backendSecret)
 	v.Set("cancelled", "yes")
 	v.Set("cancelReason", reason)
+	addMetadata(v, "", u.ticketMetadata)
+	u.lock.RUnlock()
+	for key, values := range extra {
+		v[key] = values
+	}
+
+	htclient := new(http.Client)
+	htclient.Timeout = reqTimeout
 	resp, err := htclient.PostForm(signalFinishURL.String(), v) // this takes time
 
 	// set error if http request didn't work
@@ -584,18 +1597,13 @@ func (u *UploadToLocalFile) Cancel(tellAppBackend bool, reason string,
 		}
 
 		// we don't care what's in the body of the response, but we read it
-		// anyway so that the remote site won't suffer a broken pipe
-		if resp.Body != nil {
-			respBody := make([]byte, resp.ContentLength)
-			resp.Body.Read(respBody)
-			resp.Body.Close()
-		}
+		// anyway (up to a limit) so that the remote site won't suffer a
+		// broken pipe
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body,
+			maxHandoverReplyBytes))
+		resp.Body.Close()
 	}
-
-	u.lock.Lock()
-	u.resetTimeout(u.idleTimeout)
-	u.lock.Unlock()
-	return err
+	return
 }
 
 func (u *UploadToLocalFile) CleanUp() (err error) {
@@ -620,9 +1628,11 @@ func (u *UploadToLocalFile) CleanUp() (err error) {
 		err = os.Remove(u.path)
 		if err != nil {
 			if os.IsNotExist(err) {
-				log.Printf("wanted to remove %s but it was already gone", u.path)
+				u.log.Warn("wanted to remove file but it was already gone",
+					"path", u.path)
 			} else {
-				log.Printf("could not remove %s during cleanup!", u.path)
+				u.log.Error("could not remove file during cleanup", "path", u.path,
+					"err", err)
 			}
 		}
 	}
@@ -638,6 +1648,7 @@ func (u *UploadToLocalFile) CleanUp() (err error) {
 	// make sure the timeout handling goroutine terminates, and that calls to
 	// ResetTimeout return
 	close(u.chHandleTimeoutClosed)
+	u.log.Debug("upload cleaned up")
 
 	return
 }
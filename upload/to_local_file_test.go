@@ -0,0 +1,81 @@
+/*
+Incoming!! tests for uploads to local files
+
+Copyright (C) 2014 Lars Tiede, UiT The Arctic University of Norway
+
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package upload
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClaimStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incoming-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const connections = 8
+	finishURL, _ := url.Parse("http://localhost/finish")
+	conf := Config{IdleTimeout: time.Minute, MaxConnections: connections}
+	u := newUploadToLocalFile(NewLockedUploaderPool(), nil, dir, finishURL,
+		true, "secret", "tenant", nil, conf, nil, 0, "")
+	if err = u.SetFileSize(connections * 100); err != nil {
+		t.Fatal(err)
+	}
+	if u.ClaimStart() {
+		t.Errorf("upload without data can claim its start")
+	}
+
+	// every connection of a parallel upload sends its first chunk at the
+	// same time, and only one of them gets to report the start
+	var wg sync.WaitGroup
+	claims := make(chan bool, connections)
+	for i := int64(0); i < connections; i++ {
+		if _, err = u.BindRangeToSocketHandler(i*100, i*100+100); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(start int64) {
+			defer wg.Done()
+			if err := u.ConsumeFileChunkAt(start, make([]byte, 10)); err != nil {
+				t.Error(err)
+			}
+			claims <- u.ClaimStart()
+		}(i * 100)
+	}
+	wg.Wait()
+	close(claims)
+	n := 0
+	for claimed := range claims {
+		if claimed {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("start claimed %d times, want once", n)
+	}
+	if u.ClaimStart() {
+		t.Errorf("start claimed again after all connections did")
+	}
+}
@@ -26,11 +26,109 @@ import (
 
 // InitModule initializes the upload module. At present, this is only clearing
 // the local file uploader's storage directory, which we have to do in case the
-// app was shut down while uploads were running.
+// app was shut down while uploads were running. Partial uploads that can be
+// recovered are kept; RecoverUploads takes them up.
 func InitModule(storageDir string) error {
 	return initStorageDir(storageDir)
 }
 
+// Config holds the parameters an upload runs with. The web app backend (or,
+// by default, the app configuration) decides on these when the uploader is
+// created. If Reloadable is true, the uploader's config may be replaced while
+// the upload is in progress, for example when the app configuration is
+// reloaded.
+type Config struct {
+	// size of a chunk (i.e., single message payload size), in kilobytes
+	ChunkSizeKB uint
+
+	// how many sends may the sender be ahead of receiving acks
+	SendAhead uint
+
+	// how many connections may upload ranges of the file at the same time
+	// (see BindRangeToSocketHandler)
+	MaxConnections uint
+
+	// how long the upload may be idle before it is cancelled
+	IdleTimeout time.Duration
+
+	// how long the upload may be paused before it is cancelled (0: forever)
+	PausedTimeout time.Duration
+
+	// timeout for the 'file is here' request to the app backend
+	HandoverTimeout time.Duration
+
+	// how long to wait for the app backend to confirm that it has fetched the
+	// file (if it answered 'wait')
+	HandoverConfirmTimeout time.Duration
+
+	// for how long to retry the 'file is here' request if the app backend
+	// can't be reached or answers with a server error (0: don't retry)
+	HandoverRetryWindow time.Duration
+
+	// where complete files are kept by content, and where files are taken
+	// from if we have them already (nil: no deduplication)
+	Dedup *DedupStore
+
+	// how files are encrypted at rest (nil: not at all)
+	Encryption *Encryption
+
+	// scans files before they are handed over (nil: no scanning)
+	Scanner *Scanner
+
+	// processes files before they are handed over, after scanning (nil: no
+	// processing)
+	Processing *Pipeline
+
+	// may the config be replaced during the upload?
+	Reloadable bool
+
+	// per-upload values that were applied on top of the defaults. We keep
+	// them so that they can be applied again when the config is replaced.
+	Overrides ConfigOverrides
+}
+
+// NoTimeout, as a timeout in ConfigOverrides, overrides the timeout with 0
+// (forever). 0 can't do that there, because it means "no override".
+const NoTimeout time.Duration = -1
+
+// ConfigOverrides holds per-upload values that take precedence over the
+// default upload config. Zero values mean "no override". PausedTimeout may
+// be NoTimeout, so that the upload may be paused forever.
+type ConfigOverrides struct {
+	ChunkSizeKB            uint
+	SendAhead              uint
+	IdleTimeout            time.Duration
+	PausedTimeout          time.Duration
+	HandoverTimeout        time.Duration
+	HandoverConfirmTimeout time.Duration
+}
+
+// Apply returns a copy of the given config with all overrides applied.
+func (o ConfigOverrides) Apply(c Config) Config {
+	if o.ChunkSizeKB != 0 {
+		c.ChunkSizeKB = o.ChunkSizeKB
+	}
+	if o.SendAhead != 0 {
+		c.SendAhead = o.SendAhead
+	}
+	if o.IdleTimeout != 0 {
+		c.IdleTimeout = o.IdleTimeout
+	}
+	if o.PausedTimeout == NoTimeout {
+		c.PausedTimeout = 0
+	} else if o.PausedTimeout != 0 {
+		c.PausedTimeout = o.PausedTimeout
+	}
+	if o.HandoverTimeout != 0 {
+		c.HandoverTimeout = o.HandoverTimeout
+	}
+	if o.HandoverConfirmTimeout != 0 {
+		c.HandoverConfirmTimeout = o.HandoverConfirmTimeout
+	}
+	c.Overrides = o
+	return c
+}
+
 const (
 	StateInit = iota
 	StateUploading
@@ -41,22 +139,95 @@ const (
 	StateCleanedUp
 )
 
+// how a socket handler's connection relates to the upload's other
+// connections, as Bind*ToSocketHandler tell it
+const (
+	BindFirst    = iota // the upload's first connection
+	BindAgain           // the upload had connections before, but has none now
+	BindParallel        // the upload has other connections right now
+)
+
+// StateName returns a human readable name for an upload state.
+func StateName(state int) string {
+	switch state {
+	case StateInit:
+		return "init"
+	case StateUploading:
+		return "uploading"
+	case StatePaused:
+		return "paused"
+	case StateHandingOver:
+		return "handing over"
+	case StateCancelled:
+		return "cancelled"
+	case StateFinished:
+		return "finished"
+	case StateCleanedUp:
+		return "cleaned up"
+	}
+	return "unknown"
+}
+
+// MetadataPrefix is put in front of the keys of metadata from the app backend,
+// in requests to it (and in requests from it, for new tickets).
+const MetadataPrefix = "meta."
+
+// HandoverStatus is what the app backend reports about its progress while it
+// processes a file that was handed over to it.
+type HandoverStatus struct {
+	// fraction of the work that is done, between 0 and 1. Negative if the
+	// backend didn't say.
+	Progress float64
+
+	// human readable status text, might be empty
+	Text string
+
+	// true while we scan the file, before the app backend gets it
+	Scanning bool
+}
+
 type Uploader interface {
 	// We allow only one active socket handler per upload. BindToSocketHandler
-	// allocates an uploader to a socket handler.
-	BindToSocketHandler() error
+	// allocates an uploader to a socket handler. It returns one of the Bind*
+	// constants.
+	BindToSocketHandler() (int, error)
 
 	// UnbindFromSocketHandler 'deallocates' an uploader from a socket handler.
 	UnbindFromSocketHandler() error
 
-	// SetFileSize should be called once before any chunks are uploaded.
+	// BindRangeToSocketHandler allocates a range of the file to a socket
+	// handler, for parallel uploads: the file is split into ranges, and each
+	// is uploaded over its own connection. Ranges must not overlap, there may
+	// be up to the config's MaxConnections of them at once, and none while a
+	// socket handler deals with the whole file (and vice versa). It returns
+	// one of the Bind* constants.
+	BindRangeToSocketHandler(start, end int64) (int, error)
+
+	// UnbindRangeFromSocketHandler 'deallocates' a range from a socket
+	// handler.
+	UnbindRangeFromSocketHandler(start, end int64) error
+
+	// SetFileSize must be called before any chunks are uploaded. Later calls
+	// (from other connections) must give the same size, or they fail. The
+	// size must not be negative. An empty file is complete right away.
 	SetFileSize(int64) error
 
-	// SetFileName should be called once before any chunks are uploaded. The
-	// name is the name of the file as reported by the browser. It is not the
-	// name Incoming!! should use internally.
+	// SetFileName should be called before any chunks are uploaded. The name
+	// is the name of the file as reported by the browser. It is not the name
+	// Incoming!! should use internally. Later calls must give the same name,
+	// or they fail.
 	SetFileName(string) error
 
+	// GetMetadata returns the metadata the app backend gave us with the
+	// ticket. It must not be changed.
+	GetMetadata() map[string]string
+
+	// SetFileMetadata may be called once before any chunks are uploaded,
+	// with the MIME type and modification time of the file as reported by
+	// the browser ("" and zero time if unknown). They are passed on to the
+	// app backend.
+	SetFileMetadata(mimeType string, lastModified time.Time) error
+
 	// GetFileSize returns the size of the file that is being uploaded.
 	GetFileSize() int64
 
@@ -64,10 +235,19 @@ type Uploader interface {
 	// This is not necessarily the actual file name Incoming!! uses internally.
 	GetFileName() string
 
-	// GetFilePos returns the current cursor position within the uploaded
-	// file, i.e. how many bytes have been uploaded already.
+	// GetCancelReason returns why the upload was cancelled, or an empty
+	// string if it wasn't.
+	GetCancelReason() string
+
+	// GetFilePos returns how many bytes of the file have been uploaded
+	// already. Unless the file is uploaded in ranges or out of order, this
+	// is the current cursor position within the uploaded file.
 	GetFilePos() int64
 
+	// GetMissingRanges returns the ranges within [start, end) of the file
+	// that have not been uploaded yet.
+	GetMissingRanges(start, end int64) []Range
+
 	// GetSignalFinishURL returns the web app backend URL the uploader POSTs to
 	// when the upload is finished.
 	GetSignalFinishURL() *url.URL
@@ -77,6 +257,19 @@ type Uploader interface {
 	// string might be empty, in which case there is no secret string.
 	GetBackendSecret() string
 
+	// GetTenant returns the name of the tenant (app backend) that requested
+	// the upload ticket.
+	GetTenant() string
+
+	// GetConfig returns the upload's current config.
+	GetConfig() Config
+
+	// SetConfig replaces the upload's config. The timeout is reset to the new
+	// config's IdleTimeout (or PausedTimeout, if the upload is paused). An
+	// error is returned if the upload is already handing over, finished, or
+	// cancelled.
+	SetConfig(Config) error
+
 	// GetId returns the (textual) ID of the upload.
 	GetId() string
 
@@ -84,31 +277,65 @@ type Uploader interface {
 	GetState() int
 
 	// ConsumeFileChunk synchronously stores the next file chunk to whichever
-	// store the implementation uses.
+	// store the implementation uses. The next chunk is the one that starts at
+	// the first byte that has not been uploaded yet.
 	// An error is returned if the operation fails. In that case, the write
 	// operation 'never happened'. The upload does not cancel automatically.
 	ConsumeFileChunk([]byte) error
 
+	// TakeFromDedupStore puts the file with the given SHA-256 hash (hex
+	// encoded) in place if the upload's dedup store has it, in which case the
+	// upload is complete without any chunks. The upload must be new, with
+	// its file size set. found is false if the store doesn't have the file,
+	// or if the upload doesn't use a dedup store.
+	TakeFromDedupStore(hash string) (found bool, err error)
+
+	// ConsumeFileChunkAt is like ConsumeFileChunk, but stores the chunk at
+	// the given position in the file. Chunks can come in any order. What has
+	// been uploaded is recorded in a journal next to the file, so an upload
+	// that is resumed after a pause carries on exactly from what is really in
+	// the file, even after a restart of the server (see RecoverUploads).
+	ConsumeFileChunkAt(int64, []byte) error
+
+	// ClaimStart returns true if the upload has started (it has received
+	// data, or has taken its file from the dedup store), and nobody has
+	// claimed that before. The connections of a parallel upload all see the
+	// start, and only the one that claims it reports it.
+	ClaimStart() bool
+
 	// HandFileToApp asynchronously notifies the app backend that a file with a
 	// certain id has arrived, and that the app backend can fetch / move / copy
 	// it. It then optionally waits until the app backend is finished obtaining
 	// the file (whether this wait happens is decided by the app backend).
 	// After all of that is done, HandFileToApp sends an error object to the
-	// channel the function returns. It's fine if nobody is listening.  When
-	// everything is done successfully, the state of the upload is 'finished'.
+	// channel the function returns, and closes it. It's fine if nobody is
+	// listening.  When everything is done successfully, the state of the
+	// upload is 'finished'.
+	//
+	// If the app backend can't be reached or answers with a server error,
+	// the request is retried with exponential backoff for as long as the
+	// config's HandoverRetryWindow allows.
 	//
 	// If handover is not successful, the returned error object is not nil, and
-	// the upload's state is "cancelled". CleanUp() is not automatically
-	// called.
+	// the upload's state is "cancelled". The file is kept, and the handover is
+	// put into the dead letter list given to the uploader (if any), from where
+	// it can be replayed. CleanUp() is not automatically called.
+	//
+	// The app backend answers with "done" or "wait", either as plain text or
+	// as JSON. With JSON, it can also extend the time we wait for its
+	// confirmation, and have the file renamed.
 	//
 	// HandFileToApp can be called several times while or even after its
-	// internal goroutine is running. It will always return the same channel,
-	// and write and close that channel eventually. That is to say, for each
-	// Uploader, HandFileToApp's functionality runs exactly once.
+	// internal goroutine is running, for example when the browser reconnects
+	// during handover. Each call returns a new channel that gets the outcome
+	// of the one and only handover: for each Uploader, HandFileToApp's
+	// functionality runs exactly once. If the upload was cancelled before
+	// handover, the channel gets an error right away.
 	//
-	// the two parameters are timeouts for the request to the app backend,
-	// and waiting for the confirmation request (if there will be any)
-	HandFileToApp(time.Duration, time.Duration) chan error
+	// The timeouts for the request to the app backend, and for waiting for
+	// the confirmation request (if there will be any), are taken from the
+	// upload's config.
+	HandFileToApp() chan error
 
 	// HandoverDone should be called by the app backend when it is finished
 	// obtaining the file.
@@ -116,6 +343,21 @@ type Uploader interface {
 	// if the upload was not in the "hand over file" state.
 	HandoverDone() error
 
+	// SetHandoverStatus can be called by the app backend while it processes
+	// the file after it has answered "wait". Each call resets the timeout for
+	// the app backend's confirmation. error is not nil if the upload is not
+	// in the "hand over file" state.
+	SetHandoverStatus(HandoverStatus) error
+
+	// GetHandoverStatus returns what the app backend reported last. Progress
+	// is negative if it hasn't reported anything.
+	GetHandoverStatus() HandoverStatus
+
+	// HandoverStatusChanged returns a channel that is closed when the app
+	// backend reports a new handover status. After that, call it again to
+	// learn about the next one.
+	HandoverStatusChanged() <-chan struct{}
+
 	// Cancel ends the upload. No new chunks will be accepted.  The first
 	// parameter determines whether the app backend should be notified or not.
 	// This should be set to true unless Cancel() is called from the app
@@ -137,13 +379,32 @@ type Uploader interface {
 	// Pause can be called to pause an upload while the upload is in progress.
 	// Pause will make an Uploader close the file or whatever else it writes
 	// to, and open it again when ConsumeFileChunk is called again (which
-	// "unpauses" the upload). The idle timeout is not affected by Pause, so in
-	// practice it makes (for now at least) little difference whether you call
-	// Pause, or whether you not call Pause and just let some time pass before
-	// calling ConsumeFileChunk again. This behavior is likely to change in the
-	// future.
+	// "unpauses" the upload). While the upload is paused, the config's
+	// PausedTimeout applies instead of the idle timeout, so a paused upload
+	// can survive much longer than one that just went silent. If other
+	// connections of a parallel upload are still bound, the upload is paused
+	// when the last of them has unbound.
 	Pause() error
 
+	// PauseByServer pauses the upload on behalf of the app backend or an
+	// operator, with a reason that can be shown to the user. Unlike with
+	// Pause, ConsumeFileChunk refuses chunks until ResumeByServer is called.
+	// Uploads can be paused by the server before their first chunk has
+	// arrived, too.
+	PauseByServer(reason string) error
+
+	// ResumeByServer ends a pause that PauseByServer started.
+	ResumeByServer() error
+
+	// GetServerPause returns whether the upload is paused by the server, and
+	// why.
+	GetServerPause() (paused bool, reason string)
+
+	// ServerPauseChanged returns a channel that is closed when the upload is
+	// paused or resumed by the server. After that, call it again to learn
+	// about the next change.
+	ServerPauseChanged() <-chan struct{}
+
 	// CleanUp cleans up after a finished or cancelled upload. It removes
 	// temporary data, and removes the uploader from the uploader pool.
 	CleanUp() error
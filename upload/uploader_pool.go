@@ -20,9 +20,9 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package upload
 
 import (
-	"log"
 	"sync"
 
+	"github.com/uit-no/incoming/logging"
 	"github.com/uit-no/incoming/uidpool"
 )
 
@@ -31,11 +31,19 @@ type UploaderPool interface {
 
 	Put(Uploader) string
 
+	// PutAs puts an uploader into the pool under the given id, which must not
+	// be in use (for example for an upload that is recovered after a
+	// restart).
+	PutAs(Uploader, string) error
+
 	// Remove removes an uploader, identified by its id, from the pool. No
 	// problem if the given id does not exist
 	Remove(string)
 
 	Size() int
+
+	// GetAll returns a snapshot of all uploaders currently in the pool.
+	GetAll() []Uploader
 }
 
 type LockedUploaderPool struct {
@@ -65,17 +73,32 @@ func (p *LockedUploaderPool) Put(ul Uploader) (id string) {
 	p.uploaders[id] = ul
 	p.lock.Unlock()
 
-	log.Printf("put uploader %s into pool. Pool size: %d", id, p.Size())
+	logging.Debug("put uploader into pool", "upload", id, "poolSize", p.Size())
 	return
 }
 
+func (p *LockedUploaderPool) PutAs(ul Uploader, id string) error {
+	err := p.uidPool.Add(id)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.uploaders[id] = ul
+	p.lock.Unlock()
+
+	logging.Debug("put uploader into pool", "upload", id, "poolSize", p.Size())
+	return nil
+}
+
 func (p *LockedUploaderPool) Remove(id string) {
 	p.lock.Lock()
 	delete(p.uploaders, id)
 	p.lock.Unlock()
 
 	p.uidPool.Remove(id)
-	log.Printf("removed uploader %s from pool. Pool size: %d", id, p.Size())
+	logging.Debug("removed uploader from pool", "upload", id,
+		"poolSize", p.Size())
 	return
 }
 
@@ -85,3 +108,13 @@ func (p *LockedUploaderPool) Size() (s int) {
 	p.lock.Unlock()
 	return
 }
+
+func (p *LockedUploaderPool) GetAll() (res []Uploader) {
+	p.lock.Lock()
+	res = make([]Uploader, 0, len(p.uploaders))
+	for _, ul := range p.uploaders {
+		res = append(res, ul)
+	}
+	p.lock.Unlock()
+	return
+}
@@ -23,11 +23,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"reflect"
+	"sync"
 	"time"
 
+	"github.com/uit-no/incoming/logging"
+	"github.com/uit-no/incoming/ratelimit"
 	"github.com/uit-no/incoming/upload"
 
 	"github.com/gorilla/websocket"
@@ -55,6 +58,35 @@ type MsgUploadReq struct {
 	Id          string
 	LengthBytes int64
 	Name        string
+
+	// for files of a batch: Id is the batch id, and the file is number
+	// BatchIndex (counting from 0) of BatchFileCount files. RelativePath is
+	// optional, and says where the file goes within the batch's directory
+	// (for folder uploads).
+	BatchIndex     int
+	BatchFileCount int
+	RelativePath   string
+
+	// for parallel uploads: the range of the file this connection uploads,
+	// from RangeStart up to (but not including) RangeEnd. If RangeEnd is 0,
+	// the connection uploads the whole file.
+	RangeStart int64
+	RangeEnd   int64
+
+	// optional SHA-256 hash of the file (hex encoded). If the server has a
+	// file with this hash already, it takes that one, and nothing has to be
+	// uploaded.
+	Sha256 string
+
+	// compression methods the sender can use for file chunks, in order of
+	// preference (see MsgUploadConf)
+	Compression []string
+
+	// optional MIME type and modification time (milliseconds since the
+	// epoch, 0: unknown) of the file, as the browser knows them. They are
+	// passed on to the app backend.
+	MimeType     string
+	LastModified int64
 }
 
 // MsgUploadConf is sent to the browser and contains parameters for the upload,
@@ -64,12 +96,36 @@ type MsgUploadConf struct {
 	// size of a chunk (i.e., single message payload size), in kilobytes
 	ChunkSizeKB uint
 
-	// position in file to resume uploading from (for now, always 0)
+	// position in file to resume uploading from: the first byte (of the
+	// connection's range) that we don't have
 	FilePos int64
 
+	// all ranges of bytes (of the connection's range) that we don't have,
+	// sorted. The sender starts with the first of them, and uses MsgSeek to
+	// jump to the others.
+	MissingRanges []upload.Range
+
+	// compression method the sender must use for file chunks, one of those
+	// from MsgUploadReq ("": none). Each chunk is compressed on its own, and
+	// acks and file positions count decompressed bytes.
+	Compression string
+
 	// how many sends may sender be ahead of receiving acks? If 1, sender will
 	// send message (n+1) only after ack for message (n) has been received.
 	SendAhead uint
+
+	// if the upload is paused by the server, the sender must not send
+	// anything until it gets a MsgServerPause that resumes the upload
+	PausedByServer bool
+	PauseReason    string
+}
+
+// MsgUploadConfUpdate is sent to the browser during an upload when the server
+// wants it to use a different chunk size and send-ahead from now on. Chunks
+// that are already in flight are fine.
+type MsgUploadConfUpdate struct {
+	ChunkSizeKB uint
+	SendAhead   uint
 }
 
 type MsgAck struct {
@@ -97,6 +153,49 @@ type MsgPause struct {
 	Pause bool
 }
 
+// MsgServerPause is sent to the browser when the app backend or an operator
+// pauses (Pause is true) or resumes (Pause is false) the upload. When paused,
+// the browser must stop sending chunks; chunks that are already on their way
+// are thrown away and not acked. When resumed, the browser must answer with a
+// MsgAck, and then send chunks from FilePos on. Chunks that arrive before the
+// MsgAck are thrown away, too. MissingRanges are as in MsgUploadConf.
+type MsgServerPause struct {
+	Pause         bool
+	Reason        string
+	FilePos       int64
+	MissingRanges []upload.Range
+}
+
+// MsgSeek is sent by the browser when the next chunks are not where the
+// previous chunk ended, but from FilePos on. This lets the browser send
+// missing ranges, in any order.
+type MsgSeek struct {
+	FilePos int64
+}
+
+// MsgBusy is sent to the browser when the server can't take the connection or
+// upload right now. The browser should try again after RetryAfterS seconds.
+type MsgBusy struct {
+	RetryAfterS uint
+	Reason      string
+}
+
+// MsgHandoverStatus is sent to the browser whenever the app backend reports
+// how far it has come processing the file, and when we start and stop
+// scanning the file before handover.
+type MsgHandoverStatus struct {
+	Progress float64 // between 0 and 1, negative if unknown
+	Status   string
+	Scanning bool
+}
+
+// MsgRangeDone is sent to the browser when a connection of a parallel upload
+// has uploaded its range, but other ranges are still missing. The connection
+// that completes the file gets MsgAllDone (or an error) after handover.
+type MsgRangeDone struct {
+	FilePos int64 // how many bytes of the whole file are here
+}
+
 type MsgAllDone struct {
 	Success bool // we need *some* field
 }
@@ -106,10 +205,50 @@ type MsgAllDone struct {
 func closeWebsocketNormally(conn *websocket.Conn, msg string) (err error) {
 	err = conn.WriteControl(websocket.CloseMessage,
 		websocket.FormatCloseMessage(websocket.CloseNormalClosure, msg),
-		time.Now().Add(time.Duration(appVars.config.UploadMaxIdleDurationS)*time.Second))
+		time.Now().Add(time.Duration(appVars.getConfig().UploadMaxIdleDurationS)*time.Second))
 	return
 }
 
+// wsUploadRef holds the uploader a websocket connection deals with, as soon as
+// we know which one that is. Log lines of the connection get their upload
+// fields from it, including log lines from goroutines that were started
+// before we knew the uploader.
+type wsUploadRef struct {
+	lock     sync.Mutex
+	uploader upload.Uploader
+}
+
+func (ref *wsUploadRef) set(u upload.Uploader) {
+	ref.lock.Lock()
+	ref.uploader = u
+	ref.lock.Unlock()
+}
+
+func (ref *wsUploadRef) get() upload.Uploader {
+	ref.lock.Lock()
+	defer ref.lock.Unlock()
+	return ref.uploader
+}
+
+// logFields returns lazy log fields for upload id, tenant and upload state
+func (ref *wsUploadRef) logFields() []interface{} {
+	field := func(f func(upload.Uploader) interface{}) logging.Lazy {
+		return func() interface{} {
+			if u := ref.get(); u != nil {
+				return f(u)
+			}
+			return ""
+		}
+	}
+	return []interface{}{
+		"upload", field(func(u upload.Uploader) interface{} { return u.GetId() }),
+		"tenant", field(func(u upload.Uploader) interface{} { return u.GetTenant() }),
+		"state", field(func(u upload.Uploader) interface{} {
+			return upload.StateName(u.GetState())
+		}),
+	}
+}
+
 type wsReadResult struct {
 	messageType int
 	data        []byte
@@ -122,9 +261,26 @@ type wsWriteCmd struct {
 	ch_ret      chan error
 }
 
+// how large a message may be before the upload config has been sent (which
+// sets the limit for file chunks)
+const maxControlMessageSize = 16 * 1024
+
 // wsConnHandler starts goroutines for forever reading from, and writing to, a
 // websocket connection. Reads can be read from the ch_r channel, writes be
-// sent to the ch_w channel.
+// sent to the ch_w channel. Each write times out after the given timeout.
+// The goroutines log to the given logger.
+//
+// Messages larger than readLimit can't be read. A new limit can be sent to
+// the ch_limit channel (once); the reader applies it before its next read. So
+// send it before the other side may send larger messages, for example before
+// telling it the chunk size.
+//
+// Every pingInterval, the writer sends a ping to the other side, which
+// answers with a pong by itself (browsers do that without any help from
+// JavaScript). Every pong and every message extends the read deadline by the
+// given timeout. So a connection that is idle, for example while an upload is
+// paused or handed over, stays open as long as the other side is there, and a
+// connection whose other side has silently gone away fails after timeout.
 //
 // When a read from the websocket returns an error (which for example happens
 // when the connection is closed), the read goroutine will terminate, but not
@@ -140,27 +296,44 @@ type wsWriteCmd struct {
 // websocket with a control message, just do it by sending a control message
 // directly over the conn object (this is legal).  After that, close the write
 // channel.
-func wsConnHandler(c *websocket.Conn) (<-chan *wsReadResult,
-	chan<- *wsWriteCmd) {
+func wsConnHandler(c *websocket.Conn, readLimit int64, timeout time.Duration,
+	pingInterval time.Duration, wslog *logging.Logger) (<-chan *wsReadResult,
+	chan<- *wsWriteCmd, chan<- int64) {
 
 	// channels we expose
 	ch_r := make(chan *wsReadResult)
 	ch_w := make(chan *wsWriteCmd)
+	ch_limit := make(chan int64, 1)
+
+	// the limit must be in place before the reader starts
+	c.SetReadLimit(readLimit)
+
+	// the other side is alive as long as pongs come in
+	c.SetPongHandler(func(string) error {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		return nil
+	})
 
 	// reader
 	go func() {
 		for cont := true; cont; {
-			// read from websocket forever
+			// read from websocket forever, with the latest limit. Only the
+			// reader touches the limit, so it can't change during a read.
+			select {
+			case readLimit = <-ch_limit:
+				c.SetReadLimit(readLimit)
+			default:
+			}
 			res := new(wsReadResult)
-			c.SetReadDeadline(time.Now().Add(
-				time.Duration(appVars.config.WebsocketConnectionTimeoutS) * time.Second))
+			c.SetReadDeadline(time.Now().Add(timeout))
 			res.messageType, res.data, res.err = c.ReadMessage() // err on socket close
 
 			if res.err == nil {
 				// got a message? send to read channel and read from websocket again
 				ch_r <- res
 			} else {
-				log.Printf("ws conn handler reader got error (normal at close)")
+				wslog.Debug("ws conn handler reader got error (normal at close)",
+					"err", res.err)
 				// got an error from the read? offer on read channel until timeout.
 				// Eventually, break out of loop
 				select {
@@ -172,41 +345,67 @@ func wsConnHandler(c *websocket.Conn) (<-chan *wsReadResult,
 			}
 		}
 		close(ch_r)
-		log.Printf("ws conn handler reader terminates")
+		wslog.Debug("ws conn handler reader terminates")
 		return
 	}()
 
 	// writer
 	go func() {
 		// recv from ch_w and send what is received over WriteMessage until channel
-		// is closed
-		for cmd := range ch_w {
-			c.SetWriteDeadline(time.Now().Add(
-				time.Duration(appVars.config.WebsocketConnectionTimeoutS) * time.Second))
-			err := c.WriteMessage(cmd.messageType, cmd.data)
-			cmd.ch_ret <- err
+		// is closed. Send pings in between.
+		pingTicker := time.NewTicker(pingInterval)
+		defer pingTicker.Stop()
+		for cont := true; cont; {
+			select {
+			case cmd, ok := <-ch_w:
+				if !ok {
+					cont = false
+					break
+				}
+				c.SetWriteDeadline(time.Now().Add(timeout))
+				err := c.WriteMessage(cmd.messageType, cmd.data)
+				cmd.ch_ret <- err
+			case <-pingTicker.C:
+				err := c.WriteControl(websocket.PingMessage, nil,
+					time.Now().Add(timeout))
+				if err != nil {
+					// the reader will notice soon enough
+					wslog.Debug("ws conn handler writer couldn't send ping",
+						"err", err)
+				}
+			}
 		}
 		// when channel is closed, close the websocket
-		log.Printf("ws conn handler writer closes websocket connection and terminates")
+		wslog.Debug("ws conn handler writer closes websocket connection and terminates")
 		c.Close() // reader goroutine will get an error from ReadMessage()
 		return
 	}()
-	return ch_r, ch_w
+	return ch_r, ch_w, ch_limit
 }
 
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	// "upgrade" connection to websocket connection
 	conn, err := conn_upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		logging.Warn("couldn't upgrade to websocket connection",
+			"remote", clientIP(r), "err", err)
 		return
 	}
 
-	// configure websocket connection
-	conn.SetReadLimit((int64(appVars.config.UploadChunkSizeKB) * 1024) + 4096)
+	// all log lines about this connection carry client address, and as soon
+	// as we know it, upload id, tenant and upload state
+	ulRef := new(wsUploadRef)
+	ip := clientIP(r)
+	wslog := logging.With("remote", ip).With(ulRef.logFields()...)
+
+	// this connection uses the app config as it is now, even if it is reloaded
+	// while the connection is open
+	config := appVars.getConfig()
 
 	// kick off wsConnHandler so that we can use channels to send and receive data
-	wsR, wsW := wsConnHandler(conn)
+	wsR, wsW, wsLimit := wsConnHandler(conn, maxControlMessageSize,
+		time.Duration(config.WebsocketConnectionTimeoutS)*time.Second,
+		time.Duration(config.WebsocketPingIntervalS)*time.Second, wslog)
 	defer close(wsW)
 
 	// make a write op return channel and define nifty shorthands for sending
@@ -260,7 +459,8 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			err = json.Unmarshal(*msg.MsgData, v)
 			return
 		default:
-			log.Printf("wanted to unmarshal unsupported message type %T", v)
+			wslog.Error("wanted to unmarshal unsupported message type",
+				"type", fmt.Sprintf("%T", v))
 			err = fmt.Errorf("wanted to unmarshal unsupported message type %T", v)
 			return
 		}
@@ -269,88 +469,242 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// turn the connection away if its IP has too many connections already
+	if !appVars.admission.acquireConn(ip) {
+		wslog.Warn("too many connections from client, turning it away")
+		_ = sendJSON(MsgBusy{RetryAfterS: config.BusyRetryAfterS,
+			Reason: "too many connections from your address"})
+		_ = closeWebsocketNormally(conn, "")
+		return
+	}
+	defer appVars.admission.releaseConn(ip)
+
 	// receive upload request from sender
 	req := new(MsgUploadReq)
 	err = recvJSON(req)
 	if err != nil {
-		log.Printf("Couldn't read upload request from %s: %s",
-			conn.RemoteAddr().String(), err.Error())
+		wslog.Warn("couldn't read upload request", "err", err)
 		_ = sendJSON(MsgError{Msg: "Couldn't read upload request"})
 		_ = closeWebsocketNormally(conn, "")
 		return
 	}
 
-	// get uploader for requested upload id
-	uploader, exists := appVars.uploaders.Get(req.Id)
-	if !exists {
-		log.Printf("Received upload req from %s for non-existing upload %s",
-			conn.RemoteAddr().String(), req.Id)
-		_ = sendJSON(MsgError{Msg: "Unknown upload id - maybe upload timed out?"})
+	// get uploader for requested upload id (or batch file)
+	var uploader upload.Uploader
+	if req.BatchFileCount > 0 {
+		batch, exists := appVars.batches.Get(req.Id)
+		if !exists {
+			wslog.Warn("received upload request for non-existing batch",
+				"requestedBatch", req.Id)
+			_ = sendJSON(MsgError{Msg: "Unknown batch id - maybe batch timed out?"})
+			_ = closeWebsocketNormally(conn, "")
+			return
+		}
+		var created bool
+		uploader, created, err = batch.File(req.BatchIndex, req.BatchFileCount,
+			req.LengthBytes, req.RelativePath)
+		if err != nil {
+			wslog.Warn("batch won't take file", "requestedBatch", req.Id,
+				"batchIndex", req.BatchIndex, "err", err)
+			_ = sendJSON(MsgError{Msg: fmt.Sprintf("Batch won't take file: %s", err)})
+			_ = closeWebsocketNormally(conn, "")
+			return
+		}
+		if created {
+			appVars.events.register(uploader, nil)
+		}
+	} else {
+		var exists bool
+		uploader, exists = appVars.uploaders.Get(req.Id)
+		if !exists {
+			wslog.Warn("received upload request for non-existing upload",
+				"requestedUpload", req.Id)
+			_ = sendJSON(MsgError{Msg: "Unknown upload id - maybe upload timed out?"})
+			_ = closeWebsocketNormally(conn, "")
+			return
+		}
+	}
+	ulRef.set(uploader)
+
+	// turn the upload away if there are too many active uploads already
+	if !appVars.admission.acquireUpload() {
+		wslog.Warn("too many active uploads, turning away upload",
+			"requestedUpload", req.Id)
+		_ = sendJSON(MsgBusy{RetryAfterS: config.BusyRetryAfterS,
+			Reason: "server is busy"})
 		_ = closeWebsocketNormally(conn, "")
 		return
 	}
+	defer appVars.admission.releaseUpload()
 
-	// make sure we're the only websocket handler to use that upload
-	err = uploader.BindToSocketHandler()
+	// does this connection upload the whole file, or a range of it (parallel
+	// upload)?
+	rangeStart, rangeEnd := int64(0), req.LengthBytes
+	ranged := (req.RangeEnd > 0)
+	if ranged {
+		if req.RangeStart < 0 || req.RangeStart >= req.RangeEnd ||
+			req.RangeEnd > req.LengthBytes {
+			wslog.Warn("invalid range", "rangeStart", req.RangeStart,
+				"rangeEnd", req.RangeEnd, "size", req.LengthBytes)
+			_ = sendJSON(MsgError{Msg: "Invalid range"})
+			_ = closeWebsocketNormally(conn, "")
+			return
+		}
+		rangeStart, rangeEnd = req.RangeStart, req.RangeEnd
+	}
+
+	// make sure we're the only websocket handler to use that upload (or that
+	// range of it)
+	var bind int
+	if ranged {
+		bind, err = uploader.BindRangeToSocketHandler(rangeStart, rangeEnd)
+	} else {
+		bind, err = uploader.BindToSocketHandler()
+	}
 	if err != nil {
-		log.Printf("Uploader requested by %s already in use by another websocket handler",
-			conn.RemoteAddr().String())
-		_ = sendJSON(MsgError{Msg: "Another websocket connection already deals with this upload"})
+		wslog.Warn("upload already in use by another websocket handler",
+			"err", err)
+		_ = sendJSON(MsgError{Msg: fmt.Sprintf(
+			"Another websocket connection already deals with this upload: %s", err)})
 		_ = closeWebsocketNormally(conn, "")
 		return
 	}
-	defer uploader.UnbindFromSocketHandler()
+	if ranged {
+		defer uploader.UnbindRangeFromSocketHandler(rangeStart, rangeEnd)
+	} else {
+		defer uploader.UnbindFromSocketHandler()
+	}
+	// more connections of a parallel upload are neither
+	switch bind {
+	case upload.BindFirst:
+		appVars.events.emit(uploader.GetId(), eventConnected, nil)
+	case upload.BindAgain:
+		appVars.events.emit(uploader.GetId(), eventReconnected, nil)
+	}
+
+	// a browser might connect at any point of the upload's life, for example
+	// after a page refresh. If the upload is over already, we just tell it
+	// the outcome. If it is being handed over, we carry on below as if the
+	// upload had just been completed, and wait for the outcome of the
+	// handover together with the browser.
+	switch uploader.GetState() {
+	case upload.StateFinished:
+		_ = sendJSON(MsgAllDone{true})
+		_ = closeWebsocketNormally(conn, "")
+		return
+	case upload.StateCancelled:
+		_ = sendJSON(MsgCancel{Reason: uploader.GetCancelReason()})
+		_ = closeWebsocketNormally(conn, "")
+		return
+	case upload.StateCleanedUp:
+		// only files of a batch are still around when they are cleaned up.
+		// The outcome of their handover is kept, so we can tell it.
+		if err = <-uploader.HandFileToApp(); err == nil {
+			_ = sendJSON(MsgAllDone{true})
+		} else {
+			_ = sendJSON(MsgCancel{Reason: uploader.GetCancelReason()})
+		}
+		_ = closeWebsocketNormally(conn, "")
+		return
+	case upload.StateHandingOver:
+		// the whole file is here, so the browser gets an upload config
+		// without missing ranges, and no chunks are exchanged
+		wslog.Info("reconnected while file is handed over to app")
+	}
+
+	// the upload's config decides chunk size and send-ahead for this
+	// connection
+	ulConf := uploader.GetConfig()
+	maxChunkSizeKB := ulConf.ChunkSizeKB
+
+	// should we adapt chunk size and send-ahead to the connection? Not if the
+	// app backend asked for specific values.
+	var tuner *chunkTuner
+	if config.AdaptiveUpload && ulConf.Overrides.ChunkSizeKB == 0 &&
+		ulConf.Overrides.SendAhead == 0 {
+		tuner = newChunkTuner(ulConf.ChunkSizeKB, ulConf.SendAhead,
+			config.AdaptiveMinChunkSizeKB, config.AdaptiveMaxChunkSizeKB,
+			config.AdaptiveMinSendAhead, config.AdaptiveMaxSendAhead)
+		if config.AdaptiveMaxChunkSizeKB > maxChunkSizeKB {
+			maxChunkSizeKB = config.AdaptiveMaxChunkSizeKB
+		}
+	}
+	// file chunks may come right after the upload config, and the reader
+	// takes the new limit before it reads the ack that comes first
+	wsLimit <- (int64(maxChunkSizeKB) * 1024) + 4096
 
-	// if upload is new (not resumed), set file size and name. Otherwise, make
-	// sure filesize from the request is the same as in uploader (the file on
-	// the client side might have changed...)
+	// set file size, or make sure it is the same as the upload's if another
+	// connection (earlier, or in parallel) has set it already (the file on
+	// the client side might have changed...). If upload is new (not resumed),
+	// set file name, too.
+	err = uploader.SetFileSize(req.LengthBytes)
+	if err != nil {
+		wslog.Warn("file size has changed", "size", req.LengthBytes,
+			"expectedSize", uploader.GetFileSize(), "err", err)
+		_ = sendJSON(MsgError{Msg: "File size has changed"})
+		_ = closeWebsocketNormally(conn, "")
+		return
+	}
 	state := uploader.GetState()
 	if state == upload.StateInit {
-		err = uploader.SetFileSize(req.LengthBytes)
-		if err != nil {
-			log.Printf("File size from %s is problematic: %s",
-				conn.RemoteAddr().String(), err.Error())
-			_ = sendJSON(MsgError{Msg: "File probably too large"})
-			_ = closeWebsocketNormally(conn, "")
-			return
-		}
 		err = uploader.SetFileName(req.Name)
 		if err != nil {
 			errMsg := fmt.Sprintf("File name from %s is problematic: %s",
 				conn.RemoteAddr().String(), err.Error())
-			log.Printf(errMsg)
+			wslog.Warn("file name is problematic", "name", req.Name, "err", err)
 			_ = sendJSON(MsgError{Msg: errMsg})
 			_ = closeWebsocketNormally(conn, "")
 			return
 		}
-	} else {
-		if req.LengthBytes != uploader.GetFileSize() {
-			log.Printf("File size from %s has changed",
-				conn.RemoteAddr().String())
-			_ = sendJSON(MsgError{Msg: "File size has changed"})
-			_ = closeWebsocketNormally(conn, "")
-			return
+		var lastModified time.Time
+		if req.LastModified > 0 {
+			lastModified = time.Unix(0, req.LastModified*int64(time.Millisecond))
 		}
+		_ = uploader.SetFileMetadata(req.MimeType, lastModified)
 	}
 
-	// make sure that uploader is in a state for continuing
-	if state >= upload.StateCancelled {
-		_ = sendJSON(MsgError{Msg: "upload already finished or cancelled"})
-		_ = closeWebsocketNormally(conn, "")
-		return
+	// if we have the file already, we don't need it again
+	if state == upload.StateInit && req.Sha256 != "" {
+		found, err := uploader.TakeFromDedupStore(req.Sha256)
+		if err != nil {
+			wslog.Warn("couldn't take file from dedup store, uploading it",
+				"sha256", req.Sha256, "err", err)
+		} else if found {
+			if uploader.ClaimStart() {
+				appVars.events.emit(uploader.GetId(), eventStarted,
+					url.Values{"deduplicated": {"yes"}})
+			}
+			appVars.events.progress(uploader.GetId(), uploader.GetFilePos(),
+				uploader.GetFileSize())
+		}
+	}
+
+	// this connection carries on from the first byte of its range that we
+	// don't have yet
+	missing := uploader.GetMissingRanges(rangeStart, rangeEnd)
+	pos := rangeEnd
+	if len(missing) > 0 {
+		pos = missing[0].Start
 	}
 
 	// prepare upload config message
 	var uploadConf MsgUploadConf
-	uploadConf.ChunkSizeKB = appVars.config.UploadChunkSizeKB
-	uploadConf.FilePos = uploader.GetFilePos()
-	uploadConf.SendAhead = appVars.config.UploadSendAhead
+	uploadConf.ChunkSizeKB = ulConf.ChunkSizeKB
+	uploadConf.FilePos = pos
+	uploadConf.MissingRanges = missing
+	if config.UploadCompression {
+		uploadConf.Compression = chooseCompression(req.Compression)
+	}
+	uploadConf.SendAhead = ulConf.SendAhead
+	serverPauseChanged := uploader.ServerPauseChanged()
+	serverPaused, serverPauseReason := uploader.GetServerPause()
+	uploadConf.PausedByServer = serverPaused
+	uploadConf.PauseReason = serverPauseReason
 
 	// send upload config to sender
 	err = sendJSON(uploadConf)
 	if err != nil {
-		log.Printf("Couldn't send upload config to %s",
-			conn.RemoteAddr().String())
+		wslog.Warn("couldn't send upload config", "err", err)
 		_ = sendJSON(MsgError{Msg: "Couldn't send upload config"})
 		_ = closeWebsocketNormally(conn, "")
 		return
@@ -361,8 +715,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	ack := new(MsgAck)
 	err = recvJSON(ack)
 	if err != nil {
-		log.Printf("Didn't receive ack from %s",
-			conn.RemoteAddr().String())
+		wslog.Warn("didn't receive ack", "err", err)
 		_ = sendJSON(MsgError{Msg: "Didn't receive ack"})
 		_ = closeWebsocketNormally(conn, "")
 		return
@@ -370,22 +723,56 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	if !ack.Ack {
 		// Sender won't send anything... this upload has failed for now
 		// Note that this shouldn't happen in the current implementation
-		log.Printf("Got nack from %s right before chunk transfers",
-			conn.RemoteAddr().String())
+		wslog.Warn("got nack right before chunk transfers")
 		_ = sendJSON(MsgError{Msg: "you nack-ed"})
 		_ = closeWebsocketNormally(conn, "you nack-ed")
 		return
 	}
 
+	// bandwidth limits for this upload, its tenant, and the whole server
+	uploadLimiter, tenantLimiter := appVars.bandwidth.addUpload(
+		uploader.GetId(), uploader.GetTenant())
+	defer appVars.bandwidth.removeUpload(uploader.GetId(), uploader.GetTenant())
+	limiters := []*ratelimit.Limiter{uploadLimiter, tenantLimiter,
+		appVars.bandwidth.global}
+
+	// while the upload is paused by the server (held), and until the sender
+	// has acked that it knows about the resume, we throw chunks away
+	held := serverPaused
+	awaitResumeAck := false
+
 	// receive and acknowledge messages with file chunks, pass chunks on to
-	// uploader until whole file is here
-	for uploader.GetFilePos() != uploader.GetFileSize() {
-		recv := <-wsR
+	// uploader until our range (or the whole file) is here
+	rangeComplete := (len(missing) == 0)
+	for !rangeComplete {
+		var recv *wsReadResult
+		select {
+		case recv = <-wsR:
+		case <-serverPauseChanged:
+			serverPauseChanged = uploader.ServerPauseChanged()
+			paused, reason := uploader.GetServerPause()
+			if paused && !held {
+				wslog.Info("telling client that server pauses upload")
+				held = true
+				err = sendJSON(MsgServerPause{Pause: true, Reason: reason})
+			} else if !paused && held {
+				wslog.Info("telling client that server resumes upload")
+				held = false
+				awaitResumeAck = true
+				missing = uploader.GetMissingRanges(rangeStart, rangeEnd)
+				if len(missing) > 0 {
+					pos = missing[0].Start
+				}
+				err = sendJSON(MsgServerPause{Pause: false, FilePos: pos,
+					MissingRanges: missing})
+			}
+			continue
+		}
 
 		// did the read from the socket go well?
 		if recv.err != nil {
-			log.Printf("Receive of file chunk or cancel or error or pause from %s failed",
-				conn.RemoteAddr().String())
+			wslog.Warn("receive of file chunk or cancel or error or pause failed",
+				"err", recv.err)
 			_ = sendJSON(MsgError{Msg: "Receive of file chunk failed"})
 			// TODO this happens with Chrome if the network connection is cut and then
 			// re-established quickly. We could recover from this error if we just
@@ -401,8 +788,7 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			msg := new(Msg)
 			err = json.Unmarshal(recv.data, msg)
 			if err != nil {
-				log.Printf("Got a text message now from %s that I don't understand",
-					conn.RemoteAddr().String())
+				wslog.Warn("got a text message that I don't understand")
 				_ = sendJSON(MsgError{Msg: "Did not understand text message"})
 				_ = closeWebsocketNormally(conn, "")
 				return
@@ -410,22 +796,46 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 			// unmarshal payload and deal with message (if we understand it)
 			switch msg.MsgType {
+			case "MsgAck":
+				if awaitResumeAck {
+					awaitResumeAck = false
+					continue
+				}
+				err = errors.New("unexpected ack")
+			case "MsgSeek":
+				msgSeek := new(MsgSeek)
+				err = json.Unmarshal(*msg.MsgData, msgSeek)
+				if err == nil && (msgSeek.FilePos < rangeStart ||
+					msgSeek.FilePos >= rangeEnd) {
+					err = errors.New("seek out of range")
+				}
+				if err == nil {
+					// seeks the sender sent before it knew about a server
+					// pause or resume are of no use, like its chunks
+					if !held && !awaitResumeAck {
+						pos = msgSeek.FilePos
+					}
+					continue
+				}
 			case "MsgPause":
 				msgPause := new(MsgPause)
 				err = json.Unmarshal(*msg.MsgData, msgPause)
 				if err == nil {
-					log.Printf("%s pauses upload", conn.RemoteAddr().String())
+					// the client closes the connection, and reconnects when
+					// it unpauses. We let go of the upload right away.
+					wslog.Info("client pauses upload")
 					uploader.Pause()
-					continue
+					appVars.events.emit(uploader.GetId(), eventPaused, nil)
+					_ = closeWebsocketNormally(conn, "")
+					return
 				}
 			case "MsgCancel":
 				msgCancel := new(MsgCancel)
 				err = json.Unmarshal(*msg.MsgData, msgCancel)
 				if err == nil {
-					log.Printf("%s cancels the upload: %s", conn.RemoteAddr().String(),
-						msgCancel.Reason)
+					wslog.Info("client cancels the upload", "reason", msgCancel.Reason)
 					uploader.Cancel(true, msgCancel.Reason,
-						time.Duration(appVars.config.HandoverTimeoutS)*time.Second)
+						uploader.GetConfig().HandoverTimeout)
 					uploader.CleanUp()
 					_ = sendJSON(MsgCancelAck{Ack: true})
 					_ = closeWebsocketNormally(conn, "")
@@ -435,19 +845,18 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 				msgError := new(MsgError)
 				err = json.Unmarshal(*msg.MsgData, msgError)
 				if err == nil {
-					log.Printf("error from %s, cancelling upload: %s", conn.RemoteAddr().String(),
-						msgError.Msg)
+					wslog.Warn("error from client, cancelling upload",
+						"clientError", msgError.Msg)
 					uploader.Cancel(true,
 						fmt.Sprintf("error from frontend: %s", msgError.Msg),
-						time.Duration(appVars.config.HandoverTimeoutS)*time.Second)
+						uploader.GetConfig().HandoverTimeout)
 					uploader.CleanUp()
 					_ = closeWebsocketNormally(conn, "")
 					return
 				}
 			}
 			if err != nil {
-				log.Printf("Got a text message now from %s that I don't understand",
-					conn.RemoteAddr().String())
+				wslog.Warn("got a text message that I don't understand")
 				_ = sendJSON(MsgError{Msg: "Did not understand text message"})
 				_ = closeWebsocketNormally(conn, "")
 				return
@@ -456,18 +865,35 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 
 		// did we receive something we don't understand (neither text nor binary)?
 		if recv.messageType != websocket.BinaryMessage {
-			log.Printf("Expected file chunk or text but got sth else from %s",
-				conn.RemoteAddr().String())
+			wslog.Warn("expected file chunk or text but got sth else",
+				"messageType", recv.messageType)
 			_ = sendJSON(MsgError{Msg: "Expected file chunk or text but got sth else"})
 			_ = closeWebsocketNormally(conn, "")
 			return
 		}
 
+		// chunks the sender sent before it knew about a server pause or
+		// resume are of no use
+		if held || awaitResumeAck {
+			continue
+		}
+
 		// still here? fine. consume the file chunk, and when that went well, ack
-		err = uploader.ConsumeFileChunk(recv.data)
+		chunk := recv.data
+		err = nil
+		if uploadConf.Compression != "" {
+			chunk, err = decompressChunk(uploadConf.Compression, recv.data,
+				int64(maxChunkSizeKB)*1024)
+		}
+		if err == nil {
+			if pos+int64(len(chunk)) > rangeEnd {
+				err = errors.New("chunk goes beyond the range of this connection")
+			} else {
+				err = uploader.ConsumeFileChunkAt(pos, chunk)
+			}
+		}
 		if err != nil {
-			log.Printf("uploader couldn't consume file chunk: %s",
-				err.Error())
+			wslog.Error("uploader couldn't consume file chunk", "err", err)
 			// TODO check if uploader is in cancelled state. If yes, send
 			// cancel message, not error message
 			errMsg := fmt.Sprintf("Error while consuming file chunk: %s", err.Error())
@@ -475,40 +901,105 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 			_ = closeWebsocketNormally(conn, "")
 			if uploader.GetState() != upload.StateCancelled {
 				uploader.Cancel(true, errMsg,
-					time.Duration(appVars.config.HandoverTimeoutS)*time.Second)
+					uploader.GetConfig().HandoverTimeout)
 				uploader.CleanUp()
 			}
 			return
 		}
-		err = sendJSON(MsgChunkAck{ChunkSize: int64(len(recv.data))})
+		pos += int64(len(chunk))
+		rangeComplete = (len(uploader.GetMissingRanges(rangeStart, rangeEnd)) == 0)
+		if uploader.ClaimStart() {
+			appVars.events.emit(uploader.GetId(), eventStarted, nil)
+		}
+		appVars.events.progress(uploader.GetId(), uploader.GetFilePos(),
+			uploader.GetFileSize())
+		if tuner != nil {
+			tuner.chunkReceived(len(chunk))
+		}
+
+		// hold back the ack if we're over a bandwidth limit. The sender can't
+		// send more than SendAhead chunks without acks, so this throttles it.
+		// Limits are for what goes over the network, so compressed chunks
+		// count with their compressed size.
+		if wait := ratelimit.ReserveAll(len(recv.data), limiters...); wait > 0 {
+			time.Sleep(wait)
+		}
+		err = sendJSON(MsgChunkAck{ChunkSize: int64(len(chunk))})
+
+		// tell sender to change chunk size and send-ahead if the connection
+		// would be better off with that
+		if tuner != nil && err == nil {
+			tuner.ackSent()
+			chunkSizeKB, sendAhead, changed := tuner.adjust()
+			if changed && !rangeComplete {
+				wslog.Debug("changing chunk size and send-ahead",
+					"chunkSizeKB", chunkSizeKB, "sendAhead", sendAhead)
+				err = sendJSON(MsgUploadConfUpdate{ChunkSizeKB: chunkSizeKB,
+					SendAhead: sendAhead})
+			}
+		}
+	}
+
+	// if we have uploaded a range, and other ranges are still missing, we're
+	// done. The connection that completes the file hands it over.
+	if ranged && uploader.GetFilePos() != uploader.GetFileSize() {
+		wslog.Info("range is complete", "rangeStart", rangeStart,
+			"rangeEnd", rangeEnd)
+		_ = sendJSON(MsgRangeDone{FilePos: uploader.GetFilePos()})
+		_ = closeWebsocketNormally(conn, "")
+		return
 	}
 
 	// notify web app backend that file is ready to be fetched / moved
-	ch_wait := uploader.HandFileToApp(
-		time.Duration(appVars.config.HandoverTimeoutS)*time.Second,
-		time.Duration(appVars.config.HandoverConfirmTimeoutS)*time.Second)
+	if uploader.GetState() < upload.StateHandingOver {
+		wslog.Info("file is complete, handing it over to app")
+		appVars.events.emit(uploader.GetId(), eventHandoverStarted, nil)
+	}
+	ch_wait := uploader.HandFileToApp()
 
-	// wait until uploader is finished.
-	// TODO: websocket read might time out. We need a method to prolong its timeout!
+	// if the app backend has reported progress already (because we are a
+	// reconnect), the browser should know
+	handoverStatusChanged := uploader.HandoverStatusChanged()
+	if status := uploader.GetHandoverStatus(); status.Progress >= 0 ||
+		status.Text != "" || status.Scanning {
+		_ = sendJSON(MsgHandoverStatus{Progress: status.Progress,
+			Status: status.Text, Scanning: status.Scanning})
+	}
+
+	// wait until uploader is finished. This might take long, but pings keep
+	// the connection open meanwhile.
 	for cont := true; cont; {
 		select {
 		case recv, ok := <-wsR:
 			// if this is an error (probably due to socket being closed), we are
 			// just done here.
 			if !ok || recv.err != nil {
-				log.Printf("lost connection to %s while waiting for file handover to app",
-					uploader.GetSignalFinishURL().String())
+				wslog.Warn("lost connection while waiting for file handover to app",
+					"signalFinishURL", uploader.GetSignalFinishURL().String())
 				return
 			}
 		case err = <-ch_wait:
 			//log.Printf("read wait channel: %+v", err)
 			cont = false
+		case <-handoverStatusChanged:
+			handoverStatusChanged = uploader.HandoverStatusChanged()
+			status := uploader.GetHandoverStatus()
+			_ = sendJSON(MsgHandoverStatus{Progress: status.Progress,
+				Status: status.Text, Scanning: status.Scanning})
 		}
 	}
+	if rejected, ok := err.(*upload.RejectedError); ok {
+		// scanning or processing found that the file must not be handed over
+		wslog.Info("file was rejected", "reason", rejected.Reason)
+		_ = sendJSON(MsgCancel{Reason: rejected.Reason})
+		_ = closeWebsocketNormally(conn, "")
+		return
+	}
 	if err != nil {
 		errStr := fmt.Sprintf("uploader couldn't hand file over to the application at %s: %v",
 			uploader.GetSignalFinishURL().String(), err)
-		log.Printf(errStr)
+		wslog.Warn("uploader couldn't hand file over to the application",
+			"signalFinishURL", uploader.GetSignalFinishURL().String(), "err", err)
 		_ = sendJSON(MsgError{Msg: errStr})
 		_ = closeWebsocketNormally(conn, "")
 		return
@@ -522,13 +1013,13 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 		err = sendJSON(MsgError{Msg: "upload cancelled"})
 	}
 	if err != nil {
-		log.Printf("Couldn't send 'all done' to %s",
-			conn.RemoteAddr().String())
+		wslog.Warn("couldn't send 'all done'", "err", err)
 		_ = closeWebsocketNormally(conn, "")
 		return
 	}
 
 	// done! finally, close the websocket nicely and let uploader clean up
+	wslog.Info("upload done")
 	err = closeWebsocketNormally(conn, "")
 	_ = uploader.CleanUp()
 	return